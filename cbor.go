@@ -0,0 +1,641 @@
+package stdchat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Codec is a wire encoding for msgs.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// CBOR encoder/decoder (RFC 7049). Marshal, Unmarshal.
+// Values are encoded directly to CBOR with the same field names,
+// omitempty rules and custom marshalers as JSON,
+// including omitting zero times and null MediaInfo.
+// Decoding transcodes to JSON, see CBORToJSON.
+// Encoded CBOR items are self-delimiting, a stream is a CBOR sequence.
+var CBOR Codec = cborCodec{}
+
+// GetCodec gets the Codec by name: json or cbor.
+// Returns nil if not a known codec.
+func GetCodec(name string) Codec {
+	switch name {
+	case "", "json":
+		return JSON
+	case "cbor":
+		return CBOR
+	}
+	return nil
+}
+
+type cborCodec struct{}
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error) {
+	e := &cborEncoder{}
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+func (cborCodec) Unmarshal(data []byte, v interface{}) error {
+	j, err := CBORToJSON(data)
+	if err != nil {
+		return err
+	}
+	return JSON.Unmarshal(j, v)
+}
+
+// IsCBOR returns true if data looks like a CBOR encoded msg rather than JSON.
+// Msgs are objects, so this checks for a CBOR map.
+func IsCBOR(data []byte) bool {
+	return len(data) > 0 && data[0]&0xe0 == cborMap
+}
+
+const (
+	cborUint   = 0 << 5
+	cborNegInt = 1 << 5
+	cborBytes  = 2 << 5
+	cborText   = 3 << 5
+	cborArray  = 4 << 5
+	cborMap    = 5 << 5
+	cborTag    = 6 << 5
+	cborSimple = 7 << 5
+
+	cborIndefinite = 31
+	cborBreak      = cborSimple | cborIndefinite
+
+	cborMaxDepth = 100
+	cborPrealloc = 4096 // max string length to allocate before reading.
+)
+
+var errCBORDepth = errors.New("CBOR nested too deeply")
+
+func appendCBORHead(buf []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(buf, major|byte(n))
+	case n <= math.MaxUint8:
+		return append(buf, major|24, byte(n))
+	case n <= math.MaxUint16:
+		return append(buf, major|25, byte(n>>8), byte(n))
+	case n <= math.MaxUint32:
+		return append(buf, major|26, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	default:
+		return append(buf, major|27, byte(n>>56), byte(n>>48), byte(n>>40), byte(n>>32),
+			byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+}
+
+func appendCBORNumber(buf []byte, num string) ([]byte, error) {
+	if i, err := strconv.ParseInt(num, 10, 64); err == nil {
+		if i < 0 {
+			return appendCBORHead(buf, cborNegInt, uint64(-1-i)), nil
+		}
+		return appendCBORHead(buf, cborUint, uint64(i)), nil
+	}
+	if u, err := strconv.ParseUint(num, 10, 64); err == nil {
+		return appendCBORHead(buf, cborUint, u), nil
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return buf, err
+	}
+	return appendCBORFloat(buf, f), nil
+}
+
+func appendCBORFloat(buf []byte, f float64) []byte {
+	if f32 := float32(f); float64(f32) == f {
+		n := math.Float32bits(f32)
+		return append(buf, cborSimple|26, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	n := math.Float64bits(f)
+	return append(buf, cborSimple|27, byte(n>>56), byte(n>>48), byte(n>>40), byte(n>>32),
+		byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+// JSONToCBOR transcodes a JSON value into a CBOR item.
+func JSONToCBOR(data []byte) ([]byte, error) {
+	iter := jsoniter.ParseBytes(json, data)
+	buf := appendJSONAsCBOR(nil, iter, 0)
+	if iter.Error != nil && iter.Error != io.EOF {
+		return nil, iter.Error
+	}
+	return buf, nil
+}
+
+func appendJSONAsCBOR(buf []byte, iter *jsoniter.Iterator, depth int) []byte {
+	if depth > cborMaxDepth {
+		iter.ReportError("JSONToCBOR", errCBORDepth.Error())
+		return buf
+	}
+	switch iter.WhatIsNext() {
+	case jsoniter.StringValue:
+		s := iter.ReadString()
+		buf = appendCBORHead(buf, cborText, uint64(len(s)))
+		return append(buf, s...)
+	case jsoniter.NumberValue:
+		buf, err := appendCBORNumber(buf, string(iter.ReadNumber()))
+		if err != nil {
+			iter.ReportError("JSONToCBOR", err.Error())
+		}
+		return buf
+	case jsoniter.BoolValue:
+		if iter.ReadBool() {
+			return append(buf, cborSimple|21)
+		}
+		return append(buf, cborSimple|20)
+	case jsoniter.NilValue:
+		iter.ReadNil()
+		return append(buf, cborSimple|22)
+	case jsoniter.ArrayValue:
+		var items []byte
+		n := 0
+		iter.ReadArrayCB(func(iter *jsoniter.Iterator) bool {
+			items = appendJSONAsCBOR(items, iter, depth+1)
+			n++
+			return iter.Error == nil
+		})
+		buf = appendCBORHead(buf, cborArray, uint64(n))
+		return append(buf, items...)
+	case jsoniter.ObjectValue:
+		var items []byte
+		n := 0
+		iter.ReadMapCB(func(iter *jsoniter.Iterator, key string) bool {
+			items = appendCBORHead(items, cborText, uint64(len(key)))
+			items = append(items, key...)
+			items = appendJSONAsCBOR(items, iter, depth+1)
+			n++
+			return iter.Error == nil
+		})
+		buf = appendCBORHead(buf, cborMap, uint64(n))
+		return append(buf, items...)
+	default:
+		iter.ReportError("JSONToCBOR", "invalid JSON value")
+		return buf
+	}
+}
+
+// ScanMsgs is a bufio.SplitFunc for a stream of msgs,
+// each msg is a line of JSON or a CBOR item.
+// CBOR items are split by their encoded length, they can contain newlines.
+func ScanMsgs(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if !IsCBOR(data) {
+		return bufio.ScanLines(data, atEOF)
+	}
+	n, err := cborItemLen(data, 0)
+	if err == io.ErrUnexpectedEOF {
+		if atEOF {
+			return 0, nil, err
+		}
+		return 0, nil, nil // Request more data.
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, data[:n], nil
+}
+
+// cborItemLen returns the encoded length of the first CBOR item in data,
+// or io.ErrUnexpectedEOF if data does not contain the whole item.
+func cborItemLen(data []byte, depth int) (int, error) {
+	if depth > cborMaxDepth {
+		return 0, errCBORDepth
+	}
+	if len(data) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	major, info := data[0]&0xe0, data[0]&0x1f
+	pos := 1
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		nbytes := 1 << (info - 24)
+		if len(data) < pos+nbytes {
+			return 0, io.ErrUnexpectedEOF
+		}
+		for _, b := range data[pos : pos+nbytes] {
+			n = n<<8 | uint64(b)
+		}
+		pos += nbytes
+	case info == cborIndefinite:
+		if major < cborBytes || major == cborTag {
+			return 0, errors.New("invalid indefinite CBOR item")
+		}
+		if major == cborSimple {
+			return 0, errors.New("unexpected CBOR break")
+		}
+	default:
+		return 0, errors.New("invalid CBOR additional info")
+	}
+	switch major {
+	case cborBytes, cborText:
+		if info != cborIndefinite {
+			if n > uint64(len(data)-pos) {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return pos + int(n), nil
+		}
+	case cborArray, cborMap:
+		if info != cborIndefinite {
+			nitems := uint64(1)
+			if major == cborMap {
+				nitems = 2
+			}
+			for i := uint64(0); i < n; i++ {
+				for j := uint64(0); j < nitems; j++ {
+					ilen, err := cborItemLen(data[pos:], depth+1)
+					if err != nil {
+						return 0, err
+					}
+					pos += ilen
+				}
+			}
+			return pos, nil
+		}
+	case cborTag:
+		ilen, err := cborItemLen(data[pos:], depth+1)
+		return pos + ilen, err
+	default: // Ints and simple values.
+		return pos, nil
+	}
+	// Indefinite length strings and containers, until the break.
+	for {
+		if pos >= len(data) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if data[pos] == cborBreak {
+			return pos + 1, nil
+		}
+		ilen, err := cborItemLen(data[pos:], depth+1)
+		if err != nil {
+			return 0, err
+		}
+		pos += ilen
+	}
+}
+
+// CBORToJSON transcodes a CBOR item into JSON.
+// Byte strings become base64 strings and epoch times (tag 1) become RFC3339 strings.
+func CBORToJSON(data []byte) ([]byte, error) {
+	d := NewCBORDecoder(bytes.NewReader(data))
+	j, err := d.Next()
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return j, err
+}
+
+// CBORDecoder reads a sequence of CBOR items, transcoding each into JSON.
+type CBORDecoder struct {
+	r *bufio.Reader
+}
+
+func NewCBORDecoder(r io.Reader) *CBORDecoder {
+	return &CBORDecoder{r: bufio.NewReader(r)}
+}
+
+// Next reads the next CBOR item and returns it as JSON.
+// Returns io.EOF if there are no more items.
+func (d *CBORDecoder) Next() ([]byte, error) {
+	if _, err := d.r.Peek(1); err != nil {
+		return nil, err
+	}
+	stream := jsoniter.NewStream(json, nil, 512)
+	err := d.decode(stream, 0)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		err = stream.Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stream.Buffer(), nil
+}
+
+func (d *CBORDecoder) readArg(info byte) (uint64, error) {
+	if info < 24 {
+		return uint64(info), nil
+	}
+	var nbytes int
+	switch info {
+	case 24:
+		nbytes = 1
+	case 25:
+		nbytes = 2
+	case 26:
+		nbytes = 4
+	case 27:
+		nbytes = 8
+	default:
+		return 0, errors.New("invalid CBOR additional info")
+	}
+	var buf [8]byte
+	if _, err := io.ReadFull(d.r, buf[:nbytes]); err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, b := range buf[:nbytes] {
+		n = n<<8 | uint64(b)
+	}
+	return n, nil
+}
+
+func (d *CBORDecoder) readHead() (major, info byte, n uint64, err error) {
+	ib, err := d.r.ReadByte()
+	if err != nil {
+		return
+	}
+	major, info = ib&0xe0, ib&0x1f
+	if info != cborIndefinite {
+		n, err = d.readArg(info)
+	}
+	return
+}
+
+// isBreak consumes the break byte if it is next.
+func (d *CBORDecoder) isBreak() (bool, error) {
+	b, err := d.r.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	if b[0] == cborBreak {
+		d.r.ReadByte()
+		return true, nil
+	}
+	return false, nil
+}
+
+// readString reads a byte or text string of the major type.
+func (d *CBORDecoder) readString(major, info byte, n uint64) ([]byte, error) {
+	if info != cborIndefinite {
+		if n > math.MaxInt32 {
+			return nil, errors.New("CBOR string too long")
+		}
+		// The length is untrusted, grow the buffer as the string is read.
+		var buf bytes.Buffer
+		if n <= cborPrealloc {
+			buf.Grow(int(n))
+		}
+		_, err := io.CopyN(&buf, d.r, int64(n))
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return buf.Bytes(), err
+	}
+	var buf []byte
+	for {
+		if brk, err := d.isBreak(); err != nil || brk {
+			return buf, err
+		}
+		cmajor, cinfo, cn, err := d.readHead()
+		if err != nil {
+			return nil, err
+		}
+		if cmajor != major || cinfo == cborIndefinite {
+			return nil, errors.New("invalid CBOR string chunk")
+		}
+		chunk, err := d.readString(cmajor, cinfo, cn)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, chunk...)
+	}
+}
+
+// more returns true if there is another item in the container.
+func (d *CBORDecoder) more(info byte, i, n uint64) (bool, error) {
+	if info == cborIndefinite {
+		brk, err := d.isBreak()
+		return !brk, err
+	}
+	return i < n, nil
+}
+
+func (d *CBORDecoder) readKey() (string, error) {
+	major, info, n, err := d.readHead()
+	if err != nil {
+		return "", err
+	}
+	switch major {
+	case cborText:
+		key, err := d.readString(major, info, n)
+		return string(key), err
+	case cborUint:
+		return strconv.FormatUint(n, 10), nil
+	case cborNegInt:
+		if n <= math.MaxInt64 {
+			return strconv.FormatInt(-1-int64(n), 10), nil
+		}
+	}
+	return "", errors.New("unsupported CBOR map key")
+}
+
+func (d *CBORDecoder) readFloat(info byte) (float64, error) {
+	n, err := d.readArg(info)
+	if err != nil {
+		return 0, err
+	}
+	return cborFloat(info, n), nil
+}
+
+// cborFloat converts the argument of a float to float64.
+func cborFloat(info byte, n uint64) float64 {
+	switch info {
+	case 25:
+		return float16ToFloat64(uint16(n))
+	case 26:
+		return float64(math.Float32frombits(uint32(n)))
+	default:
+		return math.Float64frombits(n)
+	}
+}
+
+func float16ToFloat64(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 0x1f:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
+
+func writeJSONFloat(stream *jsoniter.Stream, f float64, info byte) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		stream.WriteNil() // Not representable in JSON.
+	} else if info == 26 {
+		stream.WriteFloat32(float32(f))
+	} else {
+		stream.WriteFloat64(f)
+	}
+}
+
+// readEpochTime reads the content of an epoch time tag.
+func (d *CBORDecoder) readEpochTime() (time.Time, error) {
+	major, info, n, err := d.readHead()
+	if err != nil {
+		return time.Time{}, err
+	}
+	switch {
+	case major == cborUint && n <= math.MaxInt64:
+		return time.Unix(int64(n), 0).UTC(), nil
+	case major == cborNegInt && n <= math.MaxInt64:
+		return time.Unix(-1-int64(n), 0).UTC(), nil
+	case major == cborSimple && info >= 25 && info <= 27:
+		sec, frac := math.Modf(cborFloat(info, n))
+		return time.Unix(int64(sec), int64(frac*1e9)).UTC(), nil
+	}
+	return time.Time{}, errors.New("invalid CBOR epoch time")
+}
+
+func (d *CBORDecoder) decode(stream *jsoniter.Stream, depth int) error {
+	if depth > cborMaxDepth {
+		return errCBORDepth
+	}
+	ib, err := d.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	major, info := ib&0xe0, ib&0x1f
+	if major == cborSimple {
+		switch info {
+		case 20:
+			stream.WriteFalse()
+		case 21:
+			stream.WriteTrue()
+		case 25, 26, 27:
+			f, err := d.readFloat(info)
+			if err != nil {
+				return err
+			}
+			writeJSONFloat(stream, f, info)
+		case cborIndefinite:
+			return errors.New("unexpected CBOR break")
+		default: // null, undefined and other simple values.
+			if info == 24 {
+				if _, err := d.r.ReadByte(); err != nil {
+					return err
+				}
+			}
+			stream.WriteNil()
+		}
+		return nil
+	}
+	var n uint64
+	if info != cborIndefinite {
+		n, err = d.readArg(info)
+		if err != nil {
+			return err
+		}
+	} else if major < cborBytes || major == cborTag {
+		return errors.New("invalid indefinite CBOR item")
+	}
+	switch major {
+	case cborUint:
+		stream.WriteUint64(n)
+	case cborNegInt:
+		if n <= math.MaxInt64 {
+			stream.WriteInt64(-1 - int64(n))
+		} else {
+			stream.WriteFloat64(-1 - float64(n))
+		}
+	case cborBytes:
+		b, err := d.readString(major, info, n)
+		if err != nil {
+			return err
+		}
+		stream.WriteString(base64.StdEncoding.EncodeToString(b))
+	case cborText:
+		b, err := d.readString(major, info, n)
+		if err != nil {
+			return err
+		}
+		if !utf8.Valid(b) {
+			return errors.New("invalid UTF-8 in CBOR text")
+		}
+		stream.WriteString(string(b))
+	case cborArray:
+		stream.WriteArrayStart()
+		for i := uint64(0); ; i++ {
+			more, err := d.more(info, i, n)
+			if err != nil {
+				return err
+			}
+			if !more {
+				break
+			}
+			if i > 0 {
+				stream.WriteMore()
+			}
+			if err := d.decode(stream, depth+1); err != nil {
+				return err
+			}
+		}
+		stream.WriteArrayEnd()
+	case cborMap:
+		stream.WriteObjectStart()
+		for i := uint64(0); ; i++ {
+			more, err := d.more(info, i, n)
+			if err != nil {
+				return err
+			}
+			if !more {
+				break
+			}
+			if i > 0 {
+				stream.WriteMore()
+			}
+			key, err := d.readKey()
+			if err != nil {
+				return err
+			}
+			stream.WriteObjectField(key)
+			if err := d.decode(stream, depth+1); err != nil {
+				return err
+			}
+		}
+		stream.WriteObjectEnd()
+	case cborTag:
+		if n == 1 { // Epoch-based date/time.
+			t, err := d.readEpochTime()
+			if err != nil {
+				return err
+			}
+			stream.WriteString(t.Format(time.RFC3339Nano))
+			return nil
+		}
+		// Other tags are ignored, use the tagged item as is.
+		return d.decode(stream, depth+1)
+	}
+	return nil
+}
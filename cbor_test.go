@@ -0,0 +1,376 @@
+package stdchat_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	stdjson "encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"stdchat.org"
+)
+
+// normJSON decodes JSON generically, so equal values compare equal
+// regardless of the key order or number formatting.
+func normJSON(t *testing.T, data []byte) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := stdjson.Unmarshal(data, &v); err != nil {
+		t.Fatalf("invalid JSON %s: %v", data, err)
+	}
+	return v
+}
+
+func testMsgs() []interface{} {
+	tm := time.Date(2020, 1, 2, 3, 4, 5, 6000, time.UTC)
+
+	chat := &stdchat.ChatMsg{}
+	chat.Init("1", "msg/text", "irc", "net1")
+	chat.Time = tm
+	chat.Destination.Init("#chan", "group")
+	chat.From.Init("bob", "user")
+	chat.Message.SetText("hello\nworld <&>")
+	chat.Message.Set("text/markdown", "**hello** \xff")
+	chat.Values.Set("x", "y")
+	chat.Attachments = []stdchat.MediaInfo{
+		{URL: "http://localhost/a.png", Expires: tm},
+		{Name: "no url"},
+	}
+
+	enter := &stdchat.EnterMsg{}
+	enter.Init("2", "enter", "irc", "net1")
+	enter.Member.Info.User.Init("bob", "user")
+	enter.Member.Info.Photo.Init("image/*", "http://localhost/bob.png")
+
+	enterNoPhoto := &stdchat.EnterMsg{}
+	enterNoPhoto.Init("3", "enter", "irc", "net1")
+	enterNoPhoto.Member.Info.User.Init("bob", "user")
+
+	typing := &stdchat.TypingMsg{}
+	typing.Init("4", "typing", "irc", "net1")
+
+	state := &stdchat.StateMsg{}
+	state.Init("5", "state", "")
+	state.Time = time.Time{}
+	netState := &stdchat.NetworkStateInfo{Protocol: "irc", Ready: true}
+	netState.Type = "network-state"
+	netState.Network.Init("net1", "net")
+	var unknownState stdchat.StateEntry
+	if err := stdchat.JSON.Unmarshal([]byte(`{"type":"x-state","proto":"p","n":-1.5,"list":[1,"a",null,true]}`), &unknownState); err != nil {
+		panic(err)
+	}
+	state.List = []stdchat.StateEntry{{Statuser: netState}, unknownState}
+
+	history := &stdchat.HistoryResult{
+		List: []stdchat.HistoryEntry{{BaseMsger: chat}, {BaseMsger: typing}},
+		More: true,
+	}
+
+	env := &stdchat.Envelope{Payload: chat}
+	env.Topic = stdchat.Topic{Protocol: "irc", Network: "net1", Chat: "#chan", Node: "msg"}
+	env.Seq = 1 << 40
+
+	raw := &stdchat.RawEnvelope{Payload: []byte(`{"type":"other","id":"6","n":1e300}`)}
+	raw.Topic.Node = "other"
+
+	return []interface{}{
+		chat, enter, enterNoPhoto, typing, state, history, env, raw,
+		stdchat.NewCmd("7", "raw", "a", "", " "),
+		[]int{0, 23, 24, 255, 256, 65535, 65536, 1 << 32, -1, -24, -25, -1 << 40},
+		[]float64{0.5, -1.25, 1e-7, 3.4e38, 1e300},
+		[]interface{}{nil, true, false, "", []byte("bytes"), struct{}{}},
+	}
+}
+
+func TestCBORMarshalMatchesJSON(t *testing.T) {
+	for i, v := range testMsgs() {
+		j, err := stdchat.JSON.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := stdchat.CBOR.Marshal(v)
+		if err != nil {
+			t.Fatalf("%d: CBOR.Marshal: %v", i, err)
+		}
+		cj, err := stdchat.CBORToJSON(c)
+		if err != nil {
+			t.Fatalf("%d: CBORToJSON: %v", i, err)
+		}
+		if want, got := normJSON(t, j), normJSON(t, cj); !reflect.DeepEqual(want, got) {
+			t.Errorf("%d: CBOR does not match JSON:\n json %s\n cbor %s", i, j, cj)
+		}
+		jc, err := stdchat.JSONToCBOR(j)
+		if err != nil {
+			t.Fatalf("%d: JSONToCBOR: %v", i, err)
+		}
+		jcj, err := stdchat.CBORToJSON(jc)
+		if err != nil {
+			t.Fatalf("%d: CBORToJSON of JSONToCBOR: %v", i, err)
+		}
+		if want, got := normJSON(t, j), normJSON(t, jcj); !reflect.DeepEqual(want, got) {
+			t.Errorf("%d: transcoded CBOR does not match JSON:\n json %s\n cbor %s", i, j, jcj)
+		}
+	}
+}
+
+func TestCBORUnmarshalMsg(t *testing.T) {
+	chat := testMsgs()[0].(*stdchat.ChatMsg)
+	c, err := stdchat.CBOR.Marshal(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got stdchat.ChatMsg
+	if err := stdchat.CBOR.Unmarshal(c, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != chat.ID || got.Type != chat.Type || !got.Time.Equal(chat.Time) ||
+		got.GetMessageString() != chat.GetMessageString() ||
+		len(got.Attachments) != 2 || got.Attachments[0].URL != chat.Attachments[0].URL ||
+		got.Attachments[1].Name != "" { // The attachment without a URL is null.
+		t.Errorf("CBOR round-trip mismatch: %+v", got)
+	}
+}
+
+func TestCBORToJSONMajorTypes(t *testing.T) {
+	tests := []struct {
+		cbor string // hex
+		json string
+	}{
+		// Unsigned and negative ints, all argument sizes.
+		{"00", `0`},
+		{"17", `23`},
+		{"1818", `24`},
+		{"1903e8", `1000`},
+		{"1a000f4240", `1000000`},
+		{"1b000000e8d4a51000", `1000000000000`},
+		{"1bffffffffffffffff", `18446744073709551615`},
+		{"20", `-1`},
+		{"3863", `-100`},
+		{"3bffffffffffffffff", `-18446744073709551616`},
+		// Byte strings, as base64.
+		{"40", `""`},
+		{"4401020304", `"AQIDBA=="`},
+		{"5f42010243030405ff", `"AQIDBAU="`},
+		// Text strings.
+		{"60", `""`},
+		{"6161", `"a"`},
+		{"62c3bc", `"ü"`},
+		{"7f657374726561646d696e67ff", `"streaming"`},
+		// Arrays.
+		{"80", `[]`},
+		{"83010203", `[1,2,3]`},
+		{"8301820203820405", `[1,[2,3],[4,5]]`},
+		{"9f018202039f0405ffff", `[1,[2,3],[4,5]]`},
+		// Maps.
+		{"a0", `{}`},
+		{"a201020304", `{"1":2,"3":4}`},
+		{"a26161016162820203", `{"a":1,"b":[2,3]}`},
+		{"bf61610161629f0203ffff", `{"a":1,"b":[2,3]}`},
+		// Tags: epoch times, others are ignored.
+		{"c11a514b67b0", `"2013-03-21T20:04:00Z"`},
+		{"c1fb41d452d9ec200000", `"2013-03-21T20:04:00.5Z"`},
+		{"d74401020304", `"AQIDBA=="`},
+		{"c074323031332d30332d32315432303a30343a30305a", `"2013-03-21T20:04:00Z"`},
+		// Simple values and floats.
+		{"f4", `false`},
+		{"f5", `true`},
+		{"f6", `null`},
+		{"f7", `null`},
+		{"f820", `null`},
+		{"f90000", `0`},
+		{"f93c00", `1`},
+		{"f93e00", `1.5`},
+		{"f9c400", `-4`},
+		{"f90001", `5.960464477539063e-8`},
+		{"f97c00", `null`},
+		{"fa47c35000", `100000`},
+		{"fb3ff199999999999a", `1.1`},
+		{"fb7ff8000000000000", `null`},
+	}
+	for _, test := range tests {
+		data := mustHex(t, test.cbor)
+		j, err := stdchat.CBORToJSON(data)
+		if err != nil {
+			t.Errorf("%s: %v", test.cbor, err)
+			continue
+		}
+		if want, got := normJSON(t, []byte(test.json)), normJSON(t, j); !reflect.DeepEqual(want, got) {
+			t.Errorf("%s: got %s, want %s", test.cbor, j, test.json)
+		}
+	}
+}
+
+func TestCBORMapScan(t *testing.T) {
+	for _, h := range []string{"a0", "a201020304", "bf61610161629f0203ffff", "a1616140"} {
+		data := mustHex(t, h)
+		n, tok, err := stdchat.ScanMsgs(append(append([]byte{}, data...), '\n'), false)
+		if err != nil || n != len(data) || !bytes.Equal(tok, data) {
+			t.Errorf("%s: ScanMsgs got %d %x %v", h, n, tok, err)
+		}
+	}
+}
+
+func TestCBORTruncated(t *testing.T) {
+	c, err := stdchat.CBOR.Marshal(testMsgs()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(c); i++ {
+		partial := c[:i]
+		if _, err := stdchat.CBORToJSON(partial); err != io.ErrUnexpectedEOF {
+			t.Fatalf("CBORToJSON of %d/%d bytes: got %v, want %v", i, len(c), err, io.ErrUnexpectedEOF)
+		}
+		n, tok, err := stdchat.ScanMsgs(partial, false)
+		if n != 0 || tok != nil || err != nil {
+			t.Fatalf("ScanMsgs of %d/%d bytes should request more data, got %d %v", i, len(c), n, err)
+		}
+		if _, _, err := stdchat.ScanMsgs(partial, true); err != io.ErrUnexpectedEOF {
+			t.Fatalf("ScanMsgs of %d/%d bytes at EOF: got %v, want %v", i, len(c), err, io.ErrUnexpectedEOF)
+		}
+	}
+	if _, err := stdchat.CBORToJSON(nil); err != io.ErrUnexpectedEOF {
+		t.Errorf("CBORToJSON of nothing: got %v", err)
+	}
+}
+
+func TestCBORInvalid(t *testing.T) {
+	for _, h := range []string{
+		"1c",                                    // reserved additional info
+		"ff",                                    // break outside of a container
+		"5f01ff",                                // int chunk in a byte string
+		"7f7f60ff",                              // nested indefinite text chunk
+		"a1f401",                                // non-string key
+		"c1f5",                                  // invalid epoch time
+		"a1" + strings.Repeat("81", 200) + "00", // too deep
+	} {
+		if _, err := stdchat.CBORToJSON(mustHex(t, h)); err == nil || err == io.ErrUnexpectedEOF {
+			t.Errorf("%s: expected an invalid CBOR error, got %v", h, err)
+		}
+	}
+	if _, _, err := stdchat.ScanMsgs(mustHex(t, "a1"+strings.Repeat("81", 200)+"00"), false); err == nil {
+		t.Error("ScanMsgs of too deep CBOR should fail")
+	}
+}
+
+func TestCBOROversized(t *testing.T) {
+	// A string claiming to be huge must not be allocated up front.
+	for _, h := range []string{"7b000000ffffffffff", "5a7fffffff", "a1617a5affffff00"} {
+		_, err := stdchat.CBORToJSON(mustHex(t, h+"6162"))
+		if err == nil {
+			t.Errorf("%s: expected an error", h)
+		}
+	}
+	// Items larger than the scanner buffer.
+	big := stdchat.NewCmd("1", "raw", strings.Repeat("x", 1000))
+	c, err := stdchat.CBOR.Marshal(big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(c))
+	scanner.Buffer(nil, 512)
+	scanner.Split(stdchat.ScanMsgs)
+	if scanner.Scan() {
+		t.Fatal("expected no msg larger than the buffer")
+	}
+	if scanner.Err() != bufio.ErrTooLong {
+		t.Errorf("got %v, want %v", scanner.Err(), bufio.ErrTooLong)
+	}
+}
+
+func TestScanMsgsMixed(t *testing.T) {
+	var stream bytes.Buffer
+	var want []string
+	for i, v := range testMsgs()[:6] {
+		var data []byte
+		var err error
+		if i%2 == 0 {
+			data, err = stdchat.CBOR.Marshal(v)
+		} else {
+			data, err = stdchat.JSON.Marshal(v)
+			data = append(data, '\n')
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		j, err := stdchat.JSON.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, string(j))
+		stream.Write(data)
+	}
+	// Read one byte at a time so items are split across reads.
+	scanner := bufio.NewScanner(&oneByteReader{&stream})
+	scanner.Split(stdchat.ScanMsgs)
+	var n int
+	for ; scanner.Scan(); n++ {
+		if n >= len(want) {
+			t.Fatalf("too many msgs: %q", scanner.Bytes())
+		}
+		data := scanner.Bytes()
+		if stdchat.IsCBOR(data) {
+			var err error
+			data, err = stdchat.CBORToJSON(data)
+			if err != nil {
+				t.Fatalf("msg %d: %v", n, err)
+			}
+		} else if n%2 == 0 {
+			t.Errorf("msg %d should be CBOR", n)
+		}
+		if !reflect.DeepEqual(normJSON(t, []byte(want[n])), normJSON(t, data)) {
+			t.Errorf("msg %d: got %s, want %s", n, data, want[n])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(want) {
+		t.Errorf("got %d msgs, want %d", n, len(want))
+	}
+}
+
+func TestCBORDecoderSequence(t *testing.T) {
+	var seq []byte
+	for _, h := range []string{"a16161f5", "80", "f6", "6178"} {
+		seq = append(seq, mustHex(t, h)...)
+	}
+	d := stdchat.NewCBORDecoder(bytes.NewReader(seq))
+	var got []string
+	for {
+		j, err := d.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(j))
+	}
+	if want := []string{`{"a":true}`, `[]`, `null`, `"x"`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (r *oneByteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return r.r.Read(p)
+}
+
+func mustHex(t *testing.T, h string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,431 @@
+package stdchat
+
+import (
+	"encoding"
+	stdjson "encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// cborMarshaler is implemented by the types with a custom MarshalJSON,
+// to encode the same CBOR directly, see cborEncoder.
+type cborMarshaler interface {
+	marshalCBOR(e *cborEncoder) error
+}
+
+var (
+	cborMarshalerType = reflect.TypeOf((*cborMarshaler)(nil)).Elem()
+	jsonMarshalerType = reflect.TypeOf((*stdjson.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	rawMessageType    = reflect.TypeOf(jsoniter.RawMessage(nil))
+	timeType          = reflect.TypeOf(time.Time{})
+)
+
+// cborEncoder encodes values directly as CBOR, the same as the JSON encoding:
+// field names from json tags, omitempty (including for structs),
+// omitting zero times, sorted map keys and custom marshalers.
+// Types with a MarshalJSON not known to the encoder are encoded as JSON,
+// then transcoded.
+type cborEncoder struct {
+	buf   []byte
+	depth int
+}
+
+func (e *cborEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.buf = append(e.buf, cborSimple|22)
+		return nil
+	}
+	if e.depth > cborMaxDepth {
+		return errCBORDepth
+	}
+	e.depth++
+	defer func() { e.depth-- }()
+	t := v.Type()
+	if t == timeType {
+		ts := v.Interface().(time.Time)
+		e.appendText(ts.Format(time.RFC3339Nano))
+		return nil
+	}
+	if v.CanInterface() {
+		if m, ok := e.marshaler(v); ok {
+			if m == nil {
+				e.buf = append(e.buf, cborSimple|22)
+				return nil
+			}
+			return m(e)
+		}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		e.appendText(v.String())
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, cborSimple|21)
+		} else {
+			e.buf = append(e.buf, cborSimple|20)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i := v.Int(); i < 0 {
+			e.buf = appendCBORHead(e.buf, cborNegInt, uint64(-1-i))
+		} else {
+			e.buf = appendCBORHead(e.buf, cborUint, uint64(i))
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.buf = appendCBORHead(e.buf, cborUint, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return errors.New("unsupported value: " + strconv.FormatFloat(f, 'g', -1, 64))
+		}
+		e.buf = appendCBORFloat(e.buf, f)
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			e.buf = append(e.buf, cborSimple|22)
+			return nil
+		}
+		return e.encode(v.Elem())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.buf = append(e.buf, cborSimple|22)
+			return nil
+		}
+		if t == rawMessageType {
+			return e.appendJSON(v.Bytes())
+		}
+		if t.Elem().Kind() == reflect.Uint8 {
+			b := v.Bytes()
+			e.buf = appendCBORHead(e.buf, cborBytes, uint64(len(b)))
+			e.buf = append(e.buf, b...)
+			return nil
+		}
+		return e.encodeArray(v)
+	case reflect.Array:
+		return e.encodeArray(v)
+	case reflect.Map:
+		if v.IsNil() {
+			e.buf = append(e.buf, cborSimple|22)
+			return nil
+		}
+		return e.encodeMap(v)
+	case reflect.Struct:
+		return e.encodeStruct(v)
+	default:
+		return errors.New("unsupported type: " + t.String())
+	}
+	return nil
+}
+
+// marshaler returns the custom marshaler of the value, if any.
+// Returns nil and true if the value is a nil pointer with a marshaler.
+// Marshalers on the pointer are only used for nested values, like JSON.
+func (e *cborEncoder) marshaler(v reflect.Value) (func(*cborEncoder) error, bool) {
+	t := v.Type()
+	if t.Kind() != reflect.Ptr && e.depth > 1 && !hasMarshaler(t) && hasMarshaler(reflect.PtrTo(t)) {
+		if v.CanAddr() {
+			v = v.Addr()
+		} else {
+			p := reflect.New(t)
+			p.Elem().Set(v)
+			v = p
+		}
+		t = v.Type()
+	}
+	if !hasMarshaler(t) {
+		return nil, false
+	}
+	if t.Kind() == reflect.Ptr && v.IsNil() {
+		return nil, true
+	}
+	if m, ok := v.Interface().(cborMarshaler); ok {
+		return m.marshalCBOR, true
+	}
+	return func(e *cborEncoder) error {
+		j, err := JSON.Marshal(v.Interface())
+		if err != nil {
+			return err
+		}
+		return e.appendJSON(j)
+	}, true
+}
+
+func hasMarshaler(t reflect.Type) bool {
+	return t.Implements(cborMarshalerType) || t.Implements(jsonMarshalerType) ||
+		t.Implements(textMarshalerType)
+}
+
+func (e *cborEncoder) appendText(s string) {
+	if !utf8.ValidString(s) {
+		s = strings.ToValidUTF8(s, "\uFFFD") // Like JSON.
+	}
+	e.buf = appendCBORHead(e.buf, cborText, uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// appendJSON transcodes the JSON value, see JSONToCBOR.
+func (e *cborEncoder) appendJSON(data []byte) error {
+	if len(data) == 0 {
+		e.buf = append(e.buf, cborSimple|22)
+		return nil
+	}
+	item, err := JSONToCBOR(data)
+	if err != nil {
+		return err
+	}
+	e.buf = append(e.buf, item...)
+	return nil
+}
+
+func (e *cborEncoder) encodeArray(v reflect.Value) error {
+	n := v.Len()
+	e.buf = appendCBORHead(e.buf, cborArray, uint64(n))
+	for i := 0; i < n; i++ {
+		if err := e.encode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *cborEncoder) encodeMap(v reflect.Value) error {
+	type entry struct {
+		key string
+		val reflect.Value
+	}
+	entries := make([]entry, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		k := iter.Key()
+		var key string
+		switch k.Kind() {
+		case reflect.String:
+			key = k.String()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			key = strconv.FormatInt(k.Int(), 10)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			key = strconv.FormatUint(k.Uint(), 10)
+		default:
+			j, err := JSON.Marshal(v.Interface()) // Such as TextMarshaler keys.
+			if err != nil {
+				return err
+			}
+			return e.appendJSON(j)
+		}
+		entries = append(entries, entry{key, iter.Value()})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	e.buf = appendCBORHead(e.buf, cborMap, uint64(len(entries)))
+	for _, x := range entries {
+		e.appendText(x.key)
+		if err := e.encode(x.val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeStruct encodes the JSON fields of the struct, without its marshaler.
+func (e *cborEncoder) encodeStruct(v reflect.Value) error {
+	fields := cborFieldsOf(v.Type())
+	vals := make([]reflect.Value, len(fields))
+	n := 0
+	for i, f := range fields {
+		fv, ok := fieldByIndex(v, f.index)
+		if !ok || f.omitEmpty && isEmptyValue(fv, true) {
+			continue
+		}
+		vals[i] = fv
+		n++
+	}
+	e.buf = appendCBORHead(e.buf, cborMap, uint64(n))
+	for i, f := range fields {
+		if !vals[i].IsValid() {
+			continue
+		}
+		e.appendText(f.name)
+		if err := e.encode(vals[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex,
+// but returns false if an embedded pointer is nil.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// isEmptyValue is the JSON omitempty check, structs are empty if all fields are.
+// Nested values with a marshaler on the pointer are never empty, like JSON.
+func isEmptyValue(v reflect.Value, nested bool) bool {
+	t := v.Type()
+	if t == timeType {
+		return v.Interface().(time.Time).IsZero()
+	}
+	if nested && t.Kind() != reflect.Ptr && !hasMarshaler(t) && hasMarshaler(reflect.PtrTo(t)) {
+		return false
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	case reflect.Struct:
+		for _, f := range cborFieldsOf(t) {
+			if fv, ok := fieldByIndex(v, f.index); ok && !isEmptyValue(fv, true) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+type cborField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+	tagged    bool
+}
+
+var cborFieldCache sync.Map // reflect.Type -> []cborField
+
+// cborFieldsOf gets the JSON fields of the struct type, in field order.
+// Fields of embedded structs are promoted, the shallowest field wins,
+// or the tagged field if several are equally shallow, like JSON.
+func cborFieldsOf(t reflect.Type) []cborField {
+	if fields, ok := cborFieldCache.Load(t); ok {
+		return fields.([]cborField)
+	}
+	var all []cborField
+	depths := make(map[string]int)
+	type level struct {
+		t     reflect.Type
+		index []int
+	}
+	current := []level{{t, nil}}
+	visited := make(map[reflect.Type]bool)
+	for len(current) > 0 {
+		var next []level
+		var found []cborField
+		for _, lv := range current {
+			if visited[lv.t] {
+				continue
+			}
+			visited[lv.t] = true
+			for i := 0; i < lv.t.NumField(); i++ {
+				sf := lv.t.Field(i)
+				tag := sf.Tag.Get("json")
+				if tag == "-" {
+					continue
+				}
+				name, opts := tag, ""
+				if icomma := strings.IndexByte(tag, ','); icomma != -1 {
+					name, opts = tag[:icomma], tag[icomma:]
+				}
+				index := append(append([]int(nil), lv.index...), i)
+				ft := sf.Type
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if sf.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+					next = append(next, level{ft, index})
+					continue
+				}
+				if sf.PkgPath != "" { // Unexported.
+					continue
+				}
+				f := cborField{name: name, index: index, tagged: name != "",
+					omitEmpty: strings.Contains(opts, ",omitempty")}
+				if f.name == "" {
+					f.name = sf.Name
+				}
+				found = append(found, f)
+			}
+		}
+		// Fields at this depth, unless shadowed by a shallower field.
+		count := make(map[string]int)
+		tagged := make(map[string]int)
+		for _, f := range found {
+			count[f.name]++
+			if f.tagged {
+				tagged[f.name]++
+			}
+		}
+		for _, f := range found {
+			if _, ok := depths[f.name]; ok {
+				continue
+			}
+			if count[f.name] == 1 || f.tagged && tagged[f.name] == 1 {
+				all = append(all, f)
+			}
+		}
+		for _, f := range found {
+			depths[f.name] = len(f.index)
+		}
+		current = next
+	}
+	sort.Slice(all, func(i, j int) bool {
+		a, b := all[i].index, all[j].index
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+	cborFieldCache.Store(t, all)
+	return all
+}
+
+func (x StateEntry) marshalCBOR(e *cborEncoder) error {
+	return e.encode(reflect.ValueOf(x.Statuser))
+}
+
+func (x HistoryEntry) marshalCBOR(e *cborEncoder) error {
+	return e.encode(reflect.ValueOf(x.BaseMsger))
+}
+
+func (x unknownStateEntry) marshalCBOR(e *cborEncoder) error {
+	if x.raw != nil {
+		return e.appendJSON(x.raw)
+	}
+	return e.encodeStruct(reflect.ValueOf(x))
+}
+
+func (x *MediaInfo) marshalCBOR(e *cborEncoder) error {
+	if x.URL == "" {
+		e.buf = append(e.buf, cborSimple|22)
+		return nil
+	}
+	return e.encodeStruct(reflect.ValueOf(x).Elem())
+}
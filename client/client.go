@@ -0,0 +1,374 @@
+// Package client connects to a service provider, see the provider package.
+// Note: this client sub package is experimental and can change at any time!
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"nhooyr.io/websocket"
+	"stdchat.org"
+	"stdchat.org/internal/wsconn"
+	"stdchat.org/service"
+)
+
+// Options for connecting to a provider.
+type Options struct {
+	Password  string      // provider-auth password, if the provider requires it.
+	TLSConfig *tls.Config // TLS for TCP if set, also used for wss.
+}
+
+// Msg is a msg received from the provider.
+type Msg struct {
+	stdchat.Topic
+	Seq     uint64            // sequence number, 0 if none, see Resume.
+	Payload stdchat.BaseMsger // can be nil if the payload could not be parsed.
+	Raw     []byte            // the payload JSON.
+}
+
+// Client is a connection to a provider.
+// Recv should only be called from one goroutine at a time,
+// the Send functions are thread safe.
+type Client struct {
+	conn    io.ReadWriteCloser
+	r       *bufio.Reader
+	cbor    *stdchat.CBORDecoder
+	wmx     sync.Mutex
+	pending []*Msg // received before Recv, such as during Auth.
+	wait    func() error
+	calls   service.Correlator
+	lastSeq uint64 // from Recv.
+}
+
+// NewClient creates a client using an existing connection to a provider.
+// Use Auth if the provider requires a password.
+func NewClient(conn io.ReadWriteCloser) *Client {
+	r := bufio.NewReader(conn)
+	return &Client{
+		conn: conn,
+		r:    r,
+		cbor: stdchat.NewCBORDecoder(r),
+	}
+}
+
+// Dial connects to a provider at addr, using the same addr as the provider:
+// host:port for TCP (TLS if opts.TLSConfig is set), a ws:// or wss:// URL,
+// or unix:/path/to/socket
+// Performs provider-auth if opts.Password is set.
+func Dial(ctx context.Context, addr string, opts Options) (*Client, error) {
+	var conn net.Conn
+	var err error
+	if strings.HasPrefix(addr, "ws:") || strings.HasPrefix(addr, "wss:") {
+		conn, err = dialWS(ctx, addr, opts)
+	} else if strings.HasPrefix(addr, "unix:") {
+		dialer := &net.Dialer{}
+		conn, err = dialer.DialContext(ctx, "unix", strings.TrimPrefix(addr, "unix:"))
+	} else if opts.TLSConfig != nil {
+		dialer := &net.Dialer{}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			tlsConn := tls.Client(conn, tlsConfigFor(addr, opts.TLSConfig))
+			if err = tlsConn.Handshake(); err != nil {
+				conn.Close()
+			}
+			conn = tlsConn
+		}
+	} else {
+		dialer := &net.Dialer{}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return start(NewClient(conn), opts)
+}
+
+// tlsConfigFor sets the ServerName from addr if not set.
+func tlsConfigFor(addr string, config *tls.Config) *tls.Config {
+	if config.ServerName != "" {
+		return config
+	}
+	config = config.Clone()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	config.ServerName = host
+	return config
+}
+
+func dialWS(ctx context.Context, addr string, opts Options) (net.Conn, error) {
+	dopts := &websocket.DialOptions{}
+	if opts.TLSConfig != nil {
+		dopts.HTTPClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: opts.TLSConfig},
+		}
+	}
+	ws, _, err := websocket.Dial(ctx, addr, dopts)
+	if err != nil {
+		return nil, err
+	}
+	// The provider sends JSON as text messages and CBOR as binary messages.
+	return wsconn.New(ws), nil
+}
+
+// StartProcess starts a provider process using standard I/O.
+// cmd must not have Stdin or Stdout set.
+// Close closes the process's standard input and waits for it to exit.
+// Performs provider-auth if opts.Password is set.
+func StartProcess(cmd *exec.Cmd, opts Options) (*Client, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		stdin.Close()
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	c := NewClient(&struct {
+		io.Reader
+		io.WriteCloser
+	}{stdout, stdin})
+	c.wait = cmd.Wait
+	return start(c, opts)
+}
+
+func start(c *Client, opts Options) (*Client, error) {
+	if opts.Password != "" {
+		if err := c.Auth(opts.Password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Close the connection to the provider.
+func (c *Client) Close() error {
+	err := c.conn.Close()
+	if c.wait != nil {
+		if werr := c.wait(); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+// Auth performs provider-auth with the password, waiting for the result.
+// Other msgs received while waiting are returned by Recv afterwards.
+func (c *Client) Auth(password string) error {
+	id, err := c.Cmd("provider-auth", password)
+	if err != nil {
+		return err
+	}
+	var others []*Msg
+	defer func() {
+		c.pending = append(c.pending, others...)
+	}()
+	for {
+		msg, err := c.recv()
+		if msg == nil {
+			return err
+		}
+		if msg.Payload == nil || msg.Payload.GetID() != id {
+			others = append(others, msg)
+			continue
+		}
+		if msg.Node == "error" {
+			return &service.ResponseError{Msg: msg.Payload}
+		}
+		return nil
+	}
+}
+
+// Recv receives the next msg from the provider.
+// If the payload is not valid, the msg is returned along with the error,
+// and Recv can be called again.
+// Returns io.EOF when the provider closes the connection.
+// Msgs in response to a Request are delivered to the Call,
+// as well as being returned.
+// Heartbeat pings (info/provider.ping) are answered automatically.
+func (c *Client) Recv() (*Msg, error) {
+	if len(c.pending) > 0 {
+		msg := c.pending[0]
+		c.pending = c.pending[1:]
+		if msg.Seq > c.lastSeq {
+			c.lastSeq = msg.Seq
+		}
+		if msg.Payload != nil {
+			c.calls.Deliver(msg.Payload)
+		}
+		return msg, nil
+	}
+	msg, err := c.recv()
+	if msg != nil && msg.Seq > c.lastSeq {
+		c.lastSeq = msg.Seq
+	}
+	if msg == nil {
+		c.calls.Close() // No more responses.
+	} else if msg.Payload != nil {
+		c.calls.Deliver(msg.Payload)
+	}
+	return msg, err
+}
+
+func (c *Client) recv() (*Msg, error) {
+	data, err := c.next()
+	if err != nil {
+		return nil, err
+	}
+	env, err := stdchat.DecodeEnvelope(data)
+	if err != nil {
+		return nil, err
+	}
+	msg := &Msg{Topic: env.Topic, Seq: env.Seq, Raw: env.Payload}
+	msg.Payload, err = env.ParseMsg()
+	if msg.Node == "info/provider.ping" && msg.Payload != nil {
+		c.Cmd("provider-pong", msg.Payload.GetMessageString())
+	}
+	return msg, err
+}
+
+// next reads the next envelope as JSON,
+// the provider can send newline-delimited JSON or CBOR.
+func (c *Client) next() ([]byte, error) {
+	for {
+		b, err := c.r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if stdchat.IsCBOR(b) {
+			return c.cbor.Next()
+		}
+		line, err := c.r.ReadBytes('\n')
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			return line, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Send sends a msg to the provider.
+func (c *Client) Send(msg interface{}) error {
+	b, err := stdchat.EncodeMsg(msg)
+	if err != nil {
+		return err
+	}
+	c.wmx.Lock()
+	defer c.wmx.Unlock()
+	_, err = c.conn.Write(append(b, '\n'))
+	return err
+}
+
+// sendCmd sends the cmd, setting its ID if empty. Returns the ID.
+func (c *Client) sendCmd(msg *stdchat.CmdMsg) (string, error) {
+	if msg.ID == "" {
+		msg.ID = service.MakeID("")
+	}
+	return msg.ID, c.Send(msg)
+}
+
+// Request sends the cmd and returns the Call to wait for its responses.
+// The cmd gets a new ID if it does not have one.
+// Responses are only received while Recv is being called,
+// such as from a receive loop in another goroutine.
+func (c *Client) Request(msg *stdchat.CmdMsg) (*service.Call, error) {
+	if msg.ID == "" {
+		msg.ID = service.MakeID("")
+	}
+	call := c.calls.NewCall(msg.ID)
+	if err := c.Send(msg); err != nil {
+		call.Close()
+		return nil, err
+	}
+	return call, nil
+}
+
+// Do is Request and then waits for the first response.
+// A response error msg is returned as a *service.ResponseError
+func (c *Client) Do(ctx context.Context, msg *stdchat.CmdMsg) (stdchat.BaseMsger, error) {
+	call, err := c.Request(msg)
+	if err != nil {
+		return nil, err
+	}
+	defer call.Close()
+	return call.Wait(ctx)
+}
+
+// Cmd sends a command, returns the request ID.
+func (c *Client) Cmd(command string, args ...string) (string, error) {
+	return c.sendCmd(stdchat.NewCmd("", command, args...))
+}
+
+// Login sends a login request, returns the request ID.
+func (c *Client) Login(remote, userID, auth string) (string, error) {
+	return c.sendCmd(stdchat.NewLogin("", remote, userID, auth))
+}
+
+// Logout sends a logout request, returns the request ID.
+// logoutID can be the network ID or conn ID (if applicable)
+func (c *Client) Logout(logoutID string) (string, error) {
+	return c.sendCmd(stdchat.NewLogout("", logoutID))
+}
+
+// LogoutReason is Logout with a reason for logging out.
+func (c *Client) LogoutReason(logoutID, reason string) (string, error) {
+	return c.sendCmd(stdchat.NewLogoutReason("", logoutID, reason))
+}
+
+// Raw sends a raw command to the network, returns the request ID.
+func (c *Client) Raw(netID string, args ...string) (string, error) {
+	return c.sendCmd(stdchat.NewRaw("", netID, args...))
+}
+
+// LastSeq returns the highest sequence number received by Recv,
+// use it with Resume after reconnecting. Call from the Recv goroutine.
+func (c *Client) LastSeq() uint64 {
+	return c.lastSeq
+}
+
+// Resume requests the msgs after the sequence number which were missed,
+// such as from LastSeq of a previous Client, after subscribing to topics.
+// Results in info/provider.resume after the missed msgs,
+// or info/provider.resync if they are no longer available,
+// in which case use GetState. Returns the request ID.
+func (c *Client) Resume(after uint64) (string, error) {
+	return c.sendCmd(stdchat.NewResume("", after))
+}
+
+// SubscribeTopics requests only msgs with topics matching any of the patterns,
+// see stdchat.MatchTopic. Returns the request ID.
+func (c *Client) SubscribeTopics(patterns ...string) (string, error) {
+	return c.sendCmd(stdchat.NewSubscribeTopics("", patterns...))
+}
+
+// GetState requests the state, returns the request ID.
+// The state is received as a StateMsg.
+func (c *Client) GetState() (string, error) {
+	return c.Cmd("get-state")
+}
+
+// SendText sends a text msg to the destination on the network,
+// destType is the type of entity, such as user. Returns the msg ID.
+func (c *Client) SendText(netID, destID, destType, text string) (string, error) {
+	msg := &stdchat.ChatMsg{}
+	msg.Init(service.MakeID(""), "msg", "", netID)
+	msg.Destination.Init(destID, destType)
+	msg.Message.SetText(text)
+	return msg.ID, c.Send(msg)
+}
@@ -0,0 +1,75 @@
+// Command playback-provider is a provider which plays back a session
+// recorded with the -record flag of another provider,
+// for developing and testing clients without running the real service.
+//
+// Usage: playback-provider [flags] recording
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"stdchat.org/provider"
+	"stdchat.org/service"
+)
+
+func main() {
+	speed := flag.Float64("speed", 1,
+		"Playback speed, such as 2 for twice as fast, or 0 for no delays")
+	// The recording is needed for the protocol before provider.Run.
+	path, err := recordingPath(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	var entries []service.RecordEntry
+	protocol := "playback"
+	if path != "" {
+		f, err := os.Open(path)
+		if err == nil {
+			entries, err = service.ReadRecording(f)
+			f.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		for _, entry := range entries {
+			if entry.Dir == service.RecordOut && entry.Protocol != "" {
+				protocol = entry.Protocol
+				break
+			}
+		}
+	}
+	err = provider.Run(protocol,
+		func(t service.Transporter) service.Servicer {
+			return service.NewPlaybackService(t, entries, *speed)
+		})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// recordingPath gets the recording arg from the same flags as provider.Run
+// Returns an empty path for -help, so provider.Run shows the usage.
+func recordingPath(args []string) (string, error) {
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	opts := provider.DefaultOptions
+	opts.AddFlags(flags)
+	flags.Float64("speed", 1, "")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return "", nil
+		}
+		return "", err
+	}
+	if flags.NArg() != 1 {
+		return "", errors.New("expected the path to a recording")
+	}
+	return flags.Arg(0), nil
+}
@@ -0,0 +1,91 @@
+// Command stdchat-auth creates credentials for provider-auth.
+//
+// Usage:
+//
+//	stdchat-auth hash [-name name]  (reads the secret from standard input)
+//	stdchat-auth token -key path -name name [-expires 24h]
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"stdchat.org/provider"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "Usage: stdchat-auth hash|token [flags]")
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "hash":
+		err = hash(os.Args[2:])
+	case "token":
+		err = token(os.Args[2:])
+	default:
+		err = errors.New("unknown command: " + os.Args[1])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// hash writes a line for the provider -credentials file.
+func hash(args []string) error {
+	flags := flag.NewFlagSet("hash", flag.ExitOnError)
+	name := flags.String("name", "", "Credential name, to output name:hash")
+	flags.Parse(args)
+
+	secret, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	secret = strings.TrimRight(secret, "\r\n")
+	if secret == "" {
+		if err != nil {
+			return err
+		}
+		return errors.New("empty secret")
+	}
+	h, err := provider.HashSecret(secret)
+	if err != nil {
+		return err
+	}
+	if *name != "" {
+		if strings.IndexByte(*name, ':') != -1 {
+			return errors.New("name must not contain a colon")
+		}
+		h = *name + ":" + h
+	}
+	fmt.Println(h)
+	return nil
+}
+
+// token writes a token signed with the provider -tokenKey file.
+func token(args []string) error {
+	flags := flag.NewFlagSet("token", flag.ExitOnError)
+	keyPath := flags.String("key", "", "Path to the token key file")
+	name := flags.String("name", "", "Name in the token")
+	expires := flags.Duration("expires", 24*time.Hour, "Time until the token expires")
+	flags.Parse(args)
+
+	if *keyPath == "" || *name == "" {
+		return errors.New("-key and -name are required")
+	}
+	key, err := provider.LoadTokenKey(*keyPath)
+	if err != nil {
+		return err
+	}
+	ta := &provider.TokenAuth{Key: key}
+	tok, err := ta.NewToken(*name, time.Now().Add(*expires))
+	if err != nil {
+		return err
+	}
+	fmt.Println(tok)
+	return nil
+}
@@ -0,0 +1,31 @@
+// Command stdchat-schema writes the JSON Schema for the stdchat wire format.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"stdchat.org/schema"
+)
+
+func main() {
+	out := flag.String("o", "-", "Output file, or - for standard output")
+	flag.Parse()
+
+	j, err := json.MarshalIndent(schema.Generate(), "", "  ")
+	if err == nil {
+		j = append(j, '\n')
+		if *out == "-" {
+			_, err = os.Stdout.Write(j)
+		} else {
+			err = ioutil.WriteFile(*out, j, 0666)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -72,6 +72,16 @@ func IsType(msgType, part string) bool {
 			msgType[len(part)] == '/' && part == msgType[:len(part)]
 }
 
+// ParentType returns the parent type of msgType, or empty string if none.
+// For example, the parent of msg/action is msg.
+func ParentType(msgType string) string {
+	islash := strings.LastIndexByte(msgType, '/')
+	if islash == -1 {
+		return ""
+	}
+	return msgType[:islash]
+}
+
 // EntityInfo represents an entity with an ID, optional name and a type.
 type EntityInfo struct {
 	IDInfo
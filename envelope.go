@@ -0,0 +1,151 @@
+package stdchat
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Topic is where a msg is published.
+// The topic name is chat/Protocol/network/chat/node
+// where network and chat are empty if not applicable.
+type Topic struct {
+	Protocol string `json:"proto,omitempty"`
+	Network  string `json:"net,omitempty"`  // network ID
+	Chat     string `json:"chat,omitempty"` // chat ID
+	Node     string `json:"node"`           // such as msg or info/foo
+}
+
+// String returns the topic name, see Topic.
+// The network and chat IDs are path escaped, including + for MQTT.
+func (t Topic) String() string {
+	return "chat/" + t.Protocol + "/" + escapeTopicLevel(t.Network) +
+		"/" + escapeTopicLevel(t.Chat) + "/" + t.Node
+}
+
+func escapeTopicLevel(s string) string {
+	return strings.Replace(url.PathEscape(s), "+", "%2B", -1)
+}
+
+var ErrInvalidTopic = errors.New("invalid topic")
+
+// ParseTopic parses a topic name, see Topic.
+func ParseTopic(topic string) (Topic, error) {
+	parts := strings.SplitN(topic, "/", 5)
+	if len(parts) != 5 || parts[0] != "chat" || parts[4] == "" {
+		return Topic{}, ErrInvalidTopic
+	}
+	network, err := url.PathUnescape(parts[2])
+	if err != nil {
+		return Topic{}, ErrInvalidTopic
+	}
+	chat, err := url.PathUnescape(parts[3])
+	if err != nil {
+		return Topic{}, ErrInvalidTopic
+	}
+	return Topic{Protocol: parts[1], Network: network, Chat: chat, Node: parts[4]}, nil
+}
+
+// cutTopicLevel cuts the first level from the topic name or pattern.
+func cutTopicLevel(s string) (level, rest string, more bool) {
+	if i := strings.IndexByte(s, '/'); i != -1 {
+		return s[:i], s[i+1:], true
+	}
+	return s, "", false
+}
+
+// MatchTopic returns true if the topic name matches the pattern.
+// As in MQTT, + matches any one level, and # as the last level
+// matches any remaining levels, including none.
+// For example, chat/+/+/+/msg/# matches all msg nodes,
+// and chat/+/net1/# matches everything for the network net1.
+func MatchTopic(pattern, topic string) bool {
+	for {
+		plevel, prest, pmore := cutTopicLevel(pattern)
+		if plevel == "#" && !pmore {
+			return true
+		}
+		tlevel, trest, tmore := cutTopicLevel(topic)
+		if plevel != "+" && plevel != tlevel {
+			return false
+		}
+		if !tmore {
+			return !pmore || prest == "#"
+		}
+		if !pmore {
+			return false
+		}
+		pattern, topic = prest, trest
+	}
+}
+
+// ValidTopicPattern returns true if the pattern is valid for MatchTopic:
+// + and # must be whole levels, and # must be the last level.
+func ValidTopicPattern(pattern string) bool {
+	for {
+		level, rest, more := cutTopicLevel(pattern)
+		if level != "+" && level != "#" && strings.ContainsAny(level, "+#") {
+			return false
+		}
+		if level == "#" && more {
+			return false
+		}
+		if !more {
+			return true
+		}
+		pattern = rest
+	}
+}
+
+// Match returns true if the topic name matches the pattern, see MatchTopic.
+func (t Topic) Match(pattern string) bool {
+	return MatchTopic(pattern, t.String())
+}
+
+// Envelope is a published msg along with its topic.
+// This is what is sent over the wire to clients: {proto, net, chat, node, seq, payload}
+type Envelope struct {
+	Topic
+	Seq     uint64      `json:"seq,omitempty"` // sequence number, if applicable.
+	Payload interface{} `json:"payload"`
+}
+
+// RawEnvelope is a received Envelope with the payload JSON not yet decoded.
+// Use the Topic to route the payload without decoding it.
+type RawEnvelope struct {
+	Topic
+	Seq     uint64              `json:"seq,omitempty"`
+	Payload jsoniter.RawMessage `json:"payload"`
+}
+
+// ParseMsg parses the payload, see ParseBaseMsg.
+func (env *RawEnvelope) ParseMsg() (BaseMsger, error) {
+	return ParseBaseMsg(env.Payload)
+}
+
+// EncodeEnvelope encodes env into bytes using the codec, or JSON if nil.
+func EncodeEnvelope(env *Envelope, codec Codec) ([]byte, error) {
+	if codec == nil {
+		codec = JSON
+	}
+	return codec.Marshal(env)
+}
+
+// DecodeEnvelope decodes JSON or CBOR data into a RawEnvelope.
+// The payload is always JSON.
+func DecodeEnvelope(data []byte) (*RawEnvelope, error) {
+	if IsCBOR(data) {
+		var err error
+		data, err = CBORToJSON(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	env := &RawEnvelope{}
+	if err := DecodeMsg(data, env); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
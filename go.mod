@@ -10,8 +10,10 @@ require (
 	github.com/modern-go/reflect2 v1.0.1 // indirect
 	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
 	github.com/stretchr/testify v1.5.1 // indirect
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f // indirect
 	gopkg.in/yaml.v2 v2.2.8 // indirect
+	nhooyr.io/websocket v1.8.4
 )
 
 replace github.com/json-iterator/go => github.com/millerlogic/json-iterator-go v1.1.9-0.20191118175040-6551bfde9b40
@@ -0,0 +1,163 @@
+package stdchat
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// The history API is a JSON REST API served at a HistoryURL.
+// A GET request to the HistoryURL returns a HistoryResult, optionally
+// filtered and paged by the following query parameters:
+//   before=TIME    only msgs before this time (RFC3339, fractional seconds allowed)
+//   after=TIME     only msgs after this time (RFC3339, fractional seconds allowed)
+//   beforeID=ID    only msgs before the msg with this ID
+//   afterID=ID     only msgs after the msg with this ID
+//   type=TYPE      only msgs of this type (see IsType), can be repeated.
+//   limit=N        maximum number of msgs, see DefaultHistoryLimit
+// If a before is given (or no after), the newest matching msgs are returned,
+// otherwise the oldest matching msgs after the after are returned.
+// The list in the result is always in chronological order (oldest first).
+// To page backwards, use beforeID with the ID of the first msg in the list;
+// to page forwards, use afterID with the ID of the last msg in the list.
+// Page by ID rather than by time, msgs can have the same time.
+
+const (
+	DefaultHistoryLimit = 50
+	MaxHistoryLimit     = 1000
+)
+
+// HistoryQuery is a query for the history API.
+type HistoryQuery struct {
+	Before   time.Time
+	After    time.Time
+	BeforeID string
+	AfterID  string
+	Types    []string
+	Limit    int // 0 for DefaultHistoryLimit
+}
+
+// Backward returns true if the query wants the newest msgs first.
+func (q HistoryQuery) Backward() bool {
+	return !q.Before.IsZero() || q.BeforeID != "" ||
+		(q.After.IsZero() && q.AfterID == "")
+}
+
+// GetLimit gets the effective limit.
+func (q HistoryQuery) GetLimit() int {
+	if q.Limit <= 0 {
+		return DefaultHistoryLimit
+	}
+	if q.Limit > MaxHistoryLimit {
+		return MaxHistoryLimit
+	}
+	return q.Limit
+}
+
+// Match returns true if the msg matches the time and type filters.
+// The ID filters are not considered, they depend on the msg order.
+func (q HistoryQuery) Match(msg BaseMsger) bool {
+	bm := msg.GetBaseMsg()
+	if !q.Before.IsZero() && !bm.Time.Before(q.Before) {
+		return false
+	}
+	if !q.After.IsZero() && !bm.Time.After(q.After) {
+		return false
+	}
+	if len(q.Types) != 0 {
+		for _, typ := range q.Types {
+			if bm.IsType(typ) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Values encodes the query into URL query values.
+func (q HistoryQuery) Values() url.Values {
+	v := url.Values{}
+	if !q.Before.IsZero() {
+		v.Set("before", q.Before.Format(time.RFC3339Nano))
+	}
+	if !q.After.IsZero() {
+		v.Set("after", q.After.Format(time.RFC3339Nano))
+	}
+	if q.BeforeID != "" {
+		v.Set("beforeID", q.BeforeID)
+	}
+	if q.AfterID != "" {
+		v.Set("afterID", q.AfterID)
+	}
+	for _, typ := range q.Types {
+		v.Add("type", typ)
+	}
+	if q.Limit > 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	return v
+}
+
+// ParseHistoryQuery parses URL query values into a HistoryQuery.
+func ParseHistoryQuery(v url.Values) (HistoryQuery, error) {
+	q := HistoryQuery{}
+	var err error
+	if s := v.Get("before"); s != "" {
+		q.Before, err = time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return q, errors.New("invalid before time")
+		}
+	}
+	if s := v.Get("after"); s != "" {
+		q.After, err = time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return q, errors.New("invalid after time")
+		}
+	}
+	q.BeforeID = v.Get("beforeID")
+	q.AfterID = v.Get("afterID")
+	q.Types = v["type"]
+	if s := v.Get("limit"); s != "" {
+		q.Limit, err = strconv.Atoi(s)
+		if err != nil || q.Limit < 0 {
+			return q, errors.New("invalid limit")
+		}
+	}
+	return q, nil
+}
+
+// HistoryURLQuery returns historyURL with the query applied.
+func HistoryURLQuery(historyURL string, q HistoryQuery) (string, error) {
+	u, err := url.Parse(historyURL)
+	if err != nil {
+		return "", err
+	}
+	u.RawQuery = q.Values().Encode()
+	return u.String(), nil
+}
+
+// HistoryEntry is a msg in the history.
+type HistoryEntry struct {
+	BaseMsger
+}
+
+func (he HistoryEntry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(he.BaseMsger)
+}
+
+func (he *HistoryEntry) UnmarshalJSON(data []byte) error {
+	msg, err := ParseBaseMsg(data)
+	if err != nil {
+		return err
+	}
+	he.BaseMsger = msg
+	return nil
+}
+
+// HistoryResult is the JSON response of the history API.
+type HistoryResult struct {
+	List []HistoryEntry `json:"list"`           // oldest first.
+	More bool           `json:"more,omitempty"` // true if the limit cut off more msgs.
+}
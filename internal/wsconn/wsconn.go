@@ -0,0 +1,131 @@
+// Package wsconn is a net.Conn on a websocket, for provider connections.
+package wsconn
+
+import (
+	"context"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+	"stdchat.org"
+)
+
+// Conn is a net.Conn on a websocket.
+// Each Write is a websocket message: binary for CBOR, otherwise text.
+// Read returns the data of the text and binary messages as a stream.
+// When a deadline is hit, the websocket is closed.
+type Conn struct {
+	ws *websocket.Conn
+
+	writeTimer *time.Timer
+	writeCtx   context.Context
+
+	readTimer *time.Timer
+	readCtx   context.Context
+
+	readMx sync.Mutex
+	eof    bool      // locked by readMx
+	reader io.Reader // current message, locked by readMx
+}
+
+var _ net.Conn = &Conn{}
+
+// New creates a Conn on the websocket.
+func New(ws *websocket.Conn) *Conn {
+	c := &Conn{ws: ws}
+	var cancel context.CancelFunc
+	c.writeCtx, cancel = context.WithCancel(context.Background())
+	c.writeTimer = time.AfterFunc(math.MaxInt64, cancel)
+	c.writeTimer.Stop()
+	c.readCtx, cancel = context.WithCancel(context.Background())
+	c.readTimer = time.AfterFunc(math.MaxInt64, cancel)
+	c.readTimer.Stop()
+	return c
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readMx.Lock()
+	defer c.readMx.Unlock()
+	if c.eof {
+		return 0, io.EOF
+	}
+	if c.reader == nil {
+		_, r, err := c.ws.Reader(c.readCtx)
+		if err != nil {
+			switch websocket.CloseStatus(err) {
+			case websocket.StatusNormalClosure, websocket.StatusGoingAway:
+				c.eof = true
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		c.reader = r
+	}
+	n, err := c.reader.Read(b)
+	if err == io.EOF {
+		c.reader = nil
+		err = nil
+	}
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	typ := websocket.MessageText
+	if stdchat.IsCBOR(b) {
+		typ = websocket.MessageBinary // Not valid UTF-8.
+	}
+	if err := c.ws.Write(c.writeCtx, typ, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Ping sends a websocket ping frame and waits for the pong,
+// which needs a concurrent Read.
+func (c *Conn) Ping(ctx context.Context) error {
+	return c.ws.Ping(ctx)
+}
+
+func (c *Conn) Close() error {
+	return c.ws.Close(websocket.StatusNormalClosure, "")
+}
+
+type wsAddr struct{}
+
+func (wsAddr) Network() string { return "websocket" }
+func (wsAddr) String() string  { return "websocket/unknown-addr" }
+
+func (c *Conn) LocalAddr() net.Addr {
+	return wsAddr{}
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return wsAddr{}
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetWriteDeadline(t)
+	c.SetReadDeadline(t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	setTimer(c.writeTimer, t)
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	setTimer(c.readTimer, t)
+	return nil
+}
+
+func setTimer(timer *time.Timer, t time.Time) {
+	if t.IsZero() {
+		timer.Stop()
+	} else {
+		timer.Reset(time.Until(t))
+	}
+}
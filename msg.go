@@ -95,6 +95,9 @@ type ChatMsg struct {
 	From        EntityInfo  `json:"from,omitempty"`
 	ReplyToID   string      `json:"replyTo,omitempty"`
 	Attachments []MediaInfo `json:"attachments,omitempty"`
+	// Thread is the thread in the destination chat, or empty if not in a thread.
+	Thread       EntityInfo `json:"thread,omitempty"`
+	ThreadRootID string     `json:"threadRoot,omitempty"` // ID of the msg starting the thread, if known.
 }
 
 var _ ChatMsger = &ChatMsg{}
@@ -112,6 +115,11 @@ func (msg *ChatMsg) GetChatMsg() *ChatMsg {
 	return msg
 }
 
+// InThread returns true if the msg is in a thread.
+func (msg *ChatMsg) InThread() bool {
+	return msg.Thread.ID != ""
+}
+
 // ChatMsger is anything based on a ChatMsg.
 type ChatMsger interface {
 	NetMsger
@@ -132,6 +140,17 @@ type MemberInfo struct {
 	Values   ValuesInfo `json:"values,omitempty"` // member values.
 }
 
+// ThreadInfo has information on a thread in a chat.
+type ThreadInfo struct {
+	Thread     EntityInfo  `json:"thread"`            // thread
+	RootID     string      `json:"root,omitempty"`    // ID of the msg starting the thread, if known.
+	Subject    MessageInfo `json:"subject,omitempty"` // Optional.
+	NumMsgs    int         `json:"numMsgs,omitempty"` // Optional.
+	LastTime   time.Time   `json:"lastTime,omitempty"`
+	Subscribed bool        `json:"subscribed,omitempty"`
+	Values     ValuesInfo  `json:"values,omitempty"`
+}
+
 // EnterMsg is about a member entering a chat.
 type EnterMsg struct {
 	ChatMsg
@@ -165,6 +184,7 @@ type MemberChangedMsg struct {
 // Myself is not a MemberInfo because Members includes myself,
 // and SubscribeMsg is also reused for leaving, which has no need for MemberInfo.
 // See the destination type for the type of chat.
+// If the ChatMsg.Thread is set, the subscription is to that thread in the chat.
 type SubscribeMsg struct {
 	ChatMsg
 	Subject    MessageInfo  `json:"subject,omitempty"`
@@ -172,6 +192,7 @@ type SubscribeMsg struct {
 	Members    []MemberInfo `json:"members,omitempty"` // includes myself on subscribe.
 	Myself     EntityInfo   `json:"myself"`            // myself as the new member.
 	HistoryURL string       `json:"history,omitempty"` // see SubscriptionStateInfo
+	Threads    []ThreadInfo `json:"threads,omitempty"` // known threads, if supported.
 }
 
 // TypingMsg a msg for a user typing a message.
@@ -182,6 +203,72 @@ type TypingMsg struct {
 	Expires time.Time `json:"expires,omitempty"` // Optional; when typing state expires.
 }
 
+// MsgEditedMsg is a msg about a chat msg being edited.
+// The ChatMsg.Message is the new message, the ChatMsg.From is the original sender.
+// Also used as an outgoing request to edit a msg, if supported.
+type MsgEditedMsg struct {
+	ChatMsg            // msg-edited
+	MsgID   string     `json:"msgID"`            // ID of the edited ChatMsg.
+	Editor  EntityInfo `json:"editor,omitempty"` // Optional; who edited, if not From.
+	Reason  string     `json:"reason,omitempty"`
+}
+
+func (msg *MsgEditedMsg) IsMsg() bool {
+	return msg.ChatMsg.IsMsg() && msg.MsgID != ""
+}
+
+// MsgDeletedMsg is a msg about a chat msg being deleted or redacted.
+// The ChatMsg.From is the original sender, if known.
+// Also used as an outgoing request to delete a msg, if supported.
+type MsgDeletedMsg struct {
+	ChatMsg            // msg-deleted
+	MsgID   string     `json:"msgID"`            // ID of the deleted ChatMsg.
+	Editor  EntityInfo `json:"editor,omitempty"` // Optional; who deleted, if not From.
+	Reason  string     `json:"reason,omitempty"`
+}
+
+func (msg *MsgDeletedMsg) IsMsg() bool {
+	return msg.ChatMsg.IsMsg() && msg.MsgID != ""
+}
+
+// EmojiInfo is an emoji, either a unicode emoji or a custom emoji.
+type EmojiInfo struct {
+	Text  string    `json:"text"`            // The emoji, or short name if custom, e.g. :name:
+	Media MediaInfo `json:"media,omitempty"` // Custom emoji image, or no media if unicode.
+}
+
+// IsCustom returns true if this is a custom emoji.
+func (x EmojiInfo) IsCustom() bool {
+	return x.Media.URL != ""
+}
+
+// ReactionMsg is a msg about a user reacting to a chat msg.
+// The ChatMsg.From is the user who reacted.
+// Also used as an outgoing request to react to a msg, if supported.
+type ReactionMsg struct {
+	ChatMsg           // reaction
+	MsgID   string    `json:"msgID"` // ID of the ChatMsg reacted to.
+	Emoji   EmojiInfo `json:"emoji"`
+	Remove  bool      `json:"remove,omitempty"` // true if the reaction is removed.
+}
+
+func (msg *ReactionMsg) IsMsg() bool {
+	return msg.ChatMsg.IsMsg() && msg.MsgID != "" && msg.Emoji.Text != ""
+}
+
+// ReceiptMsg is a msg about a user receiving or reading a chat msg.
+// The type is receipt/delivered or receipt/read,
+// the ChatMsg.From is the user and the BaseMsg.Time is when it happened.
+// A read receipt implies all prior msgs in the chat are also read.
+type ReceiptMsg struct {
+	ChatMsg        // receipt/*
+	MsgID   string `json:"msgID"` // ID of the ChatMsg delivered or read.
+}
+
+func (msg *ReceiptMsg) IsMsg() bool {
+	return msg.ChatMsg.IsMsg() && msg.MsgID != ""
+}
+
 // ConnState represents the connection state.
 // Note that ConnectFailed during Connecting or Reconnecting does not
 // indicate the end of the connection attempt, a Disconnected does.
@@ -217,6 +304,7 @@ func (msg *ConnMsg) Init(id, typ, protocol, netID string, connID string, state C
 type unknownStateEntry struct {
 	Type     string `json:"type"`
 	Protocol string `json:"proto"`
+	raw      []byte // the original JSON, if decoded.
 }
 
 func (x unknownStateEntry) GetType() string {
@@ -231,6 +319,17 @@ func (x unknownStateEntry) String() string {
 	return "unknown state: " + x.Type
 }
 
+func (x unknownStateEntry) MarshalJSON() ([]byte, error) {
+	if x.raw != nil {
+		return x.raw, nil
+	}
+	type m unknownStateEntry // Bypass MarshalJSON recursion.
+	return json.Marshal(m(x))
+}
+
+// StateEntry is a state in a StateMsg.
+// The Statuser is decoded into the type registered with RegisterStateType,
+// or an unknown state if the type is not registered.
 type StateEntry struct {
 	Statuser
 }
@@ -239,37 +338,24 @@ func (se StateEntry) MarshalJSON() ([]byte, error) {
 	return json.Marshal(se.Statuser)
 }
 
-func (se StateEntry) UnmarshalJSON(data []byte) error {
+func (se *StateEntry) UnmarshalJSON(data []byte) error {
 	var x unknownStateEntry
 	err := json.Unmarshal(data, &x)
 	if err != nil {
 		return err
 	}
-	switch x.Type {
-	case "proto-state":
-		var x ProtocolStateInfo
-		err = json.Unmarshal(data, &x)
-		if err != nil {
-			return err
-		}
-		se.Statuser = &x
-	case "network-state":
-		var x NetworkStateInfo
-		err = json.Unmarshal(data, &x)
-		if err != nil {
-			return err
-		}
-		se.Statuser = &x
-	case "subscription-state":
-		var x SubscriptionStateInfo
-		err = json.Unmarshal(data, &x)
-		if err != nil {
-			return err
-		}
-		se.Statuser = &x
-	default: // Rather than error, just silently produce an unknown state:
+	newState := LookupStateType(x.Type)
+	if newState == nil { // Rather than error, just silently produce an unknown state:
+		x.raw = append([]byte(nil), data...)
 		se.Statuser = x
+		return nil
+	}
+	state := newState()
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return err
 	}
+	se.Statuser = state
 	return nil
 }
 
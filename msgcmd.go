@@ -1,5 +1,7 @@
 package stdchat
 
+import "strconv"
+
 // CmdMsg is a msg for a command.
 // The Message should be empty, it is reserved for future use.
 type CmdMsg struct {
@@ -53,3 +55,53 @@ func NewRaw(id, netID string, args ...string) *CmdMsg {
 	cmd.Network.Init(netID, "net")
 	return cmd
 }
+
+// NewSubscribeThread is a request to subscribe to a thread in a chat.
+// Results in a SubscribeMsg with the thread, if supported.
+func NewSubscribeThread(id, netID, chatID, threadID string) *CmdMsg {
+	cmd := NewCmd(id, "subscribe-thread", chatID, threadID)
+	cmd.Network.Init(netID, "net")
+	return cmd
+}
+
+// NewUnsubscribeThread is a request to unsubscribe from a thread in a chat.
+func NewUnsubscribeThread(id, netID, chatID, threadID string) *CmdMsg {
+	cmd := NewCmd(id, "unsubscribe-thread", chatID, threadID)
+	cmd.Network.Init(netID, "net")
+	return cmd
+}
+
+// NewMarkRead is a request to mark a chat as read up to and including msgID.
+// Results in a receipt/read ReceiptMsg from myself, if supported.
+func NewMarkRead(id, netID, chatID, msgID string) *CmdMsg {
+	cmd := NewCmd(id, "mark-read", chatID, msgID)
+	cmd.Network.Init(netID, "net")
+	return cmd
+}
+
+// NewSubscribeTopics is a request to a provider to only send msgs
+// with topics matching any of the patterns, see MatchTopic.
+// Results in an info/provider.topics msg with the current patterns.
+func NewSubscribeTopics(id string, patterns ...string) *CmdMsg {
+	return NewCmd(id, "subscribe-topics", patterns...)
+}
+
+// NewUnsubscribeTopics is a request to a provider to remove topic patterns,
+// or all patterns if none are specified, which means all msgs are sent.
+func NewUnsubscribeTopics(id string, patterns ...string) *CmdMsg {
+	return NewCmd(id, "unsubscribe-topics", patterns...)
+}
+
+// NewResume is a request to a provider to send the msgs after the
+// sequence number, which were missed while disconnected.
+// Results in info/provider.resume after the msgs,
+// or info/provider.resync if the msgs are no longer available.
+func NewResume(id string, after uint64) *CmdMsg {
+	return NewCmd(id, "resume", strconv.FormatUint(after, 10))
+}
+
+// NewAcceptFormats is a request for msgs to this client to include the MIME types,
+// converting from the MIME types emitted by the protocol if needed.
+func NewAcceptFormats(id string, msgTypes ...string) *CmdMsg {
+	return NewCmd(id, "accept-formats", msgTypes...)
+}
@@ -1,47 +1,102 @@
 package stdchat
 
-import "errors"
+import (
+	"errors"
+	"sort"
+	"sync"
+)
 
 var ErrInvalidMsg = errors.New("not a valid message")
 
+// NewMsgFunc creates a new empty msg for decoding.
+type NewMsgFunc = func() BaseMsger
+
+var msgTypes = struct {
+	mx    sync.RWMutex
+	types map[string]NewMsgFunc // locked by mx
+}{types: make(map[string]NewMsgFunc)}
+
+// RegisterMsgType registers a msg type for ParseBaseMsg.
+// newMsg is used for msgs of type typ and its subtypes (see IsType),
+// the most specific registered type wins.
+// For example, registering msg/irc.ctcp lets a provider package decode
+// msg/irc.ctcp and msg/irc.ctcp/* into its own msg struct.
+func RegisterMsgType(typ string, newMsg NewMsgFunc) {
+	if typ == "" {
+		panic("empty msg type")
+	}
+	if newMsg == nil {
+		panic("nil newMsg")
+	}
+	msgTypes.mx.Lock()
+	defer msgTypes.mx.Unlock()
+	msgTypes.types[typ] = newMsg
+}
+
+// LookupMsgType finds the most specific registered msg type for msgType,
+// or returns nil if none.
+func LookupMsgType(msgType string) NewMsgFunc {
+	msgTypes.mx.RLock()
+	defer msgTypes.mx.RUnlock()
+	for typ := msgType; typ != ""; typ = ParentType(typ) {
+		if newMsg, ok := msgTypes.types[typ]; ok {
+			return newMsg
+		}
+	}
+	return nil
+}
+
+// MsgTypes returns the registered msg types, sorted.
+func MsgTypes() []string {
+	msgTypes.mx.RLock()
+	defer msgTypes.mx.RUnlock()
+	list := make([]string, 0, len(msgTypes.types))
+	for typ := range msgTypes.types {
+		list = append(list, typ)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func init() {
+	RegisterMsgType("enter", func() BaseMsger { return &EnterMsg{} })
+	RegisterMsgType("leave", func() BaseMsger { return &LeaveMsg{} })
+	RegisterMsgType("user-changed", func() BaseMsger { return &UserChangedMsg{} })
+	RegisterMsgType("member-changed", func() BaseMsger { return &MemberChangedMsg{} })
+	RegisterMsgType("subscribe", func() BaseMsger { return &SubscribeMsg{} })
+	RegisterMsgType("unsubscribe", func() BaseMsger { return &SubscribeMsg{} })
+	RegisterMsgType("msg-edited", func() BaseMsger { return &MsgEditedMsg{} })
+	RegisterMsgType("msg-deleted", func() BaseMsger { return &MsgDeletedMsg{} })
+	RegisterMsgType("reaction", func() BaseMsger { return &ReactionMsg{} })
+	RegisterMsgType("receipt", func() BaseMsger { return &ReceiptMsg{} })
+	RegisterMsgType("typing", func() BaseMsger { return &TypingMsg{} })
+	RegisterMsgType("conn-state", func() BaseMsger { return &ConnMsg{} })
+	RegisterMsgType("state", func() BaseMsger { return &StateMsg{} })
+	RegisterMsgType("cmd", func() BaseMsger { return &CmdMsg{} })
+}
+
 // ParseBaseMsg parses rawMsg JSON into a specific base msg type.
+// See RegisterMsgType for how the specific type is chosen.
 func ParseBaseMsg(rawMsg []byte) (BaseMsger, error) {
 	msg := &ChatMsg{}
 	err := DecodeMsg(rawMsg, msg)
 	if err != nil {
 		return nil, err
 	}
-	switch {
-	case msg.IsType("enter"):
-		return reparseBaseMsg(&EnterMsg{}, rawMsg)
-	case msg.IsType("leave"):
-		return reparseBaseMsg(&LeaveMsg{}, rawMsg)
-	case msg.IsType("user-changed"):
-		return reparseBaseMsg(&UserChangedMsg{}, rawMsg)
-	case msg.IsType("member-changed"):
-		return reparseBaseMsg(&MemberChangedMsg{}, rawMsg)
-	case msg.IsType("subscribe") || msg.IsType("unsubscribe"):
-		return reparseBaseMsg(&SubscribeMsg{}, rawMsg)
-	case msg.IsType("typing"):
-		return reparseBaseMsg(&TypingMsg{}, rawMsg)
-	case msg.IsType("conn-state"):
-		return reparseBaseMsg(&ConnMsg{}, rawMsg)
-	case msg.IsType("state"):
-		return reparseBaseMsg(&StateMsg{}, rawMsg)
-	case msg.IsType("cmd"):
-		return reparseBaseMsg(&CmdMsg{}, rawMsg)
-	default: // Default rules:
-		if msg.IsMsg() {
-			return msg, nil
-		}
-		if msg.BaseMsg.IsMsg() {
-			if msg.Network.ID != "" {
-				return &NetMsg{BaseMsg: msg.BaseMsg, Network: msg.Network}, nil
-			}
-			return &msg.BaseMsg, nil
+	if newMsg := LookupMsgType(msg.Type); newMsg != nil {
+		return reparseBaseMsg(newMsg(), rawMsg)
+	}
+	// Default rules:
+	if msg.IsMsg() {
+		return msg, nil
+	}
+	if msg.BaseMsg.IsMsg() {
+		if msg.Network.ID != "" {
+			return &NetMsg{BaseMsg: msg.BaseMsg, Network: msg.Network}, nil
 		}
-		return msg, ErrInvalidMsg
+		return &msg.BaseMsg, nil
 	}
+	return msg, ErrInvalidMsg
 }
 
 func reparseBaseMsg(msg BaseMsger, rawMsg []byte) (BaseMsger, error) {
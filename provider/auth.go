@@ -0,0 +1,293 @@
+package provider
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var (
+	ErrAuthFailed   = errors.New("authentication failed")
+	ErrAuthLocked   = errors.New("too many authentication attempts, try again later")
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// Authenticator checks the args of provider-auth,
+// returns the identity of the authenticated client.
+// Returns ErrAuthFailed if the credentials are not accepted.
+type Authenticator interface {
+	Authenticate(args []string) (string, error)
+}
+
+// AuthenticatorFunc implements Authenticator.
+type AuthenticatorFunc func(args []string) (string, error)
+
+func (f AuthenticatorFunc) Authenticate(args []string) (string, error) {
+	return f(args)
+}
+
+// MultiAuth tries each Authenticator in order, until one accepts.
+// Returns the last error other than ErrAuthFailed, or ErrAuthFailed.
+type MultiAuth []Authenticator
+
+func (ma MultiAuth) Authenticate(args []string) (string, error) {
+	var lastErr error = ErrAuthFailed
+	for _, auth := range ma {
+		identity, err := auth.Authenticate(args)
+		if err == nil {
+			return identity, nil
+		}
+		if err != ErrAuthFailed {
+			lastErr = err
+		}
+	}
+	return "", lastErr
+}
+
+const secretHashPrefix = "pbkdf2-sha256"
+
+// DefaultHashIterations is the PBKDF2 (HMAC-SHA256) iterations used by HashSecret.
+const DefaultHashIterations = 100000
+
+// HashSecret hashes the secret for Credentials,
+// in the form pbkdf2-sha256$iterations$salt$hash
+func HashSecret(secret string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	hash := pbkdf2.Key([]byte(secret), salt, DefaultHashIterations, sha256.Size, sha256.New)
+	return secretHashPrefix + "$" + strconv.Itoa(DefaultHashIterations) + "$" +
+		base64.RawStdEncoding.EncodeToString(salt) + "$" +
+		base64.RawStdEncoding.EncodeToString(hash), nil
+}
+
+// CheckSecret returns true if the secret matches the hash from HashSecret.
+func CheckSecret(hash, secret string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != secretHashPrefix {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(want) == 0 {
+		return false
+	}
+	got := pbkdf2.Key([]byte(secret), salt, iter, len(want), sha256.New)
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// Credentials are named secrets, hashed with HashSecret.
+// Authenticates provider-auth name secret, the identity is the name.
+type Credentials map[string]string
+
+// dummySecretHash is checked for unknown names.
+const dummySecretHash = "pbkdf2-sha256$100000$28x3yPEFnmpe6n8nWTBEyQ$ED6AzslHnR/boyxyY0RtndlU3B0smSYs0ynBWc6+p3E"
+
+func (creds Credentials) Authenticate(args []string) (string, error) {
+	if len(args) != 2 {
+		return "", ErrAuthFailed
+	}
+	hash, ok := creds[args[0]]
+	if !ok {
+		hash = dummySecretHash // Take the same time for unknown names.
+	}
+	if !CheckSecret(hash, args[1]) || !ok {
+		return "", ErrAuthFailed
+	}
+	return args[0], nil
+}
+
+// LoadCredentials loads Credentials from a file with lines of name:hash
+// Blank lines and lines starting with # are ignored.
+func LoadCredentials(path string) (Credentials, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	creds := make(Credentials)
+	scan := bufio.NewScanner(f)
+	for lineno := 1; scan.Scan(); lineno++ {
+		line := strings.TrimSpace(scan.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 || !strings.HasPrefix(line[i+1:], secretHashPrefix+"$") {
+			return nil, errors.New(path + ":" + strconv.Itoa(lineno) +
+				": expected name:" + secretHashPrefix + "$...")
+		}
+		creds[line[:i]] = line[i+1:]
+	}
+	return creds, scan.Err()
+}
+
+// TokenAuth authenticates provider-auth token
+// where the token is from NewToken with the same Key.
+// The identity is the name in the token.
+type TokenAuth struct {
+	Key []byte
+}
+
+// LoadTokenKey loads the key for TokenAuth from a file.
+func LoadTokenKey(path string) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key = []byte(strings.TrimSpace(string(key)))
+	if len(key) < 16 {
+		return nil, errors.New("token key too short: " + path)
+	}
+	return key, nil
+}
+
+func (ta *TokenAuth) sign(payload string) string {
+	mac := hmac.New(sha256.New, ta.Key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// NewToken creates a token for the name, which expires at the time.
+// The token is name.expires.signature where expires is unix seconds,
+// the name must not contain a dot.
+func (ta *TokenAuth) NewToken(name string, expires time.Time) (string, error) {
+	if name == "" || strings.IndexByte(name, '.') != -1 {
+		return "", errors.New("invalid token name")
+	}
+	payload := name + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + ta.sign(payload), nil
+}
+
+func (ta *TokenAuth) Authenticate(args []string) (string, error) {
+	if len(args) != 1 || len(ta.Key) == 0 {
+		return "", ErrAuthFailed
+	}
+	token := args[0]
+	i := strings.LastIndexByte(token, '.')
+	if i == -1 {
+		return "", ErrAuthFailed
+	}
+	payload, sig := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(ta.sign(payload))) {
+		return "", ErrAuthFailed
+	}
+	j := strings.IndexByte(payload, '.')
+	if j == -1 {
+		return "", ErrAuthFailed
+	}
+	expires, err := strconv.ParseInt(payload[j+1:], 10, 64)
+	if err != nil {
+		return "", ErrAuthFailed
+	}
+	if time.Now().Unix() >= expires {
+		return "", ErrTokenExpired
+	}
+	return payload[:j], nil
+}
+
+// authThrottle limits failed provider-auth attempts per remote,
+// locking out the remote after too many failures.
+type authThrottle struct {
+	maxAttempts int           // no limit if <= 0
+	lockout     time.Duration // also the window for counting failures.
+	mx          sync.Mutex
+	remotes     map[string]*authAttempts // locked by mx
+}
+
+type authAttempts struct {
+	failures int
+	since    time.Time // first failure, or the lockout.
+}
+
+func newAuthThrottle(maxAttempts int, lockout time.Duration) *authThrottle {
+	return &authThrottle{
+		maxAttempts: maxAttempts,
+		lockout:     lockout,
+		remotes:     make(map[string]*authAttempts),
+	}
+}
+
+// remoteKey gets the remote host of the conn, without the port.
+// Returns empty if the conn has no host address, such as unix sockets
+// and standard I/O, which are not throttled.
+func remoteKey(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return ""
+}
+
+// locked returns true if the remote is locked out.
+func (at *authThrottle) locked(remote string) bool {
+	if at.maxAttempts <= 0 || remote == "" {
+		return false
+	}
+	at.mx.Lock()
+	defer at.mx.Unlock()
+	a := at.remotes[remote]
+	if a == nil {
+		return false
+	}
+	if time.Since(a.since) >= at.lockout {
+		delete(at.remotes, remote)
+		return false
+	}
+	return a.failures >= at.maxAttempts
+}
+
+func (at *authThrottle) fail(remote string) {
+	if at.maxAttempts <= 0 || remote == "" {
+		return
+	}
+	at.mx.Lock()
+	defer at.mx.Unlock()
+	now := time.Now()
+	if len(at.remotes) >= 1024 {
+		for k, a := range at.remotes {
+			if now.Sub(a.since) >= at.lockout {
+				delete(at.remotes, k)
+			}
+		}
+	}
+	a := at.remotes[remote]
+	if a == nil || now.Sub(a.since) >= at.lockout {
+		a = &authAttempts{since: now}
+		at.remotes[remote] = a
+	}
+	a.failures++
+	if a.failures == at.maxAttempts {
+		a.since = now // Locked out from now.
+	}
+}
+
+func (at *authThrottle) succeed(remote string) {
+	at.mx.Lock()
+	defer at.mx.Unlock()
+	delete(at.remotes, remote)
+}
@@ -0,0 +1,80 @@
+package provider
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"stdchat.org"
+	"stdchat.org/service"
+)
+
+// pinger is a conn which can send its own pings, such as websocket ping frames.
+// Ping waits for the pong.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// touch extends the idle timeout of the conn, upon input.
+func (cinfo *clientInfo) touch() {
+	if timeout := cinfo.p.opts.IdleTimeout; timeout > 0 {
+		cinfo.tp.conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+}
+
+// startHeartbeat sends pings every HeartbeatInterval until stopHeartbeat,
+// as websocket ping frames if supported by the conn,
+// otherwise as info/provider.ping msgs, which clients answer with provider-pong
+func (cinfo *clientInfo) startHeartbeat() {
+	interval := cinfo.p.opts.HeartbeatInterval
+	if interval <= 0 {
+		return
+	}
+	cinfo.stopHeartbeat = make(chan struct{})
+	go cinfo.heartbeat(interval, cinfo.stopHeartbeat)
+}
+
+func (cinfo *clientInfo) heartbeat(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !cinfo.ping(interval) {
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// ping sends a ping, returns false if the conn failed.
+func (cinfo *clientInfo) ping(timeout time.Duration) bool {
+	if p, ok := cinfo.tp.conn.(pinger); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := p.Ping(ctx)
+		cancel()
+		if err != nil {
+			return isTimeout(err) // Leave it to the idle timeout.
+		}
+		cinfo.touch() // The pong is input.
+		return true
+	}
+	outmsg := &stdchat.BaseMsg{}
+	outmsg.Init(service.MakeID(""), "info/provider.ping", cinfo.tp.GetProtocol())
+	outmsg.Message.SetText(strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10))
+	err := cinfo.tp.write(&stdchat.Envelope{
+		Topic:   stdchat.Topic{Protocol: cinfo.tp.Protocol, Node: "info/provider.ping"},
+		Payload: outmsg,
+	})
+	return err == nil
+}
+
+func isTimeout(err error) bool {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	return err == context.DeadlineExceeded
+}
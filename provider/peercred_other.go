@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package provider
+
+import (
+	"errors"
+	"net"
+)
+
+// getPeerUID is not supported on this platform.
+func getPeerUID(conn *net.UnixConn) (int, error) {
+	return -1, errors.New("peer credentials not supported")
+}
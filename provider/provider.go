@@ -3,7 +3,10 @@
 package provider
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"io"
@@ -12,11 +15,13 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/millerlogic/server-go"
-	"github.com/millerlogic/server-go/wslisten"
 	"stdchat.org"
 	"stdchat.org/service"
 )
@@ -28,9 +33,37 @@ type Options struct {
 	MaxConns     int
 	AutoPassword bool
 	AutoExit     bool
+	Encoding     string // wire encoding for new conns: json (default) or cbor
+	LogDir       string // record published msgs to a log, see service.LogTransport
+	RecordPath   string // record the session to a file, see service.Recorder
 
 	// TLS:
 	CertPath, PrivateKeyPath string
+	ClientCAPath             string // require client certs signed by these CAs (PEM)
+	ClientCertAuth           bool   // a verified client cert identity skips provider-auth
+
+	// Unix domain sockets:
+	SocketMode string // octal permissions for the socket file, such as 0600
+	PeerAuth   string // comma separated user IDs (or self) which skip provider-auth
+
+	// Authentication, in addition to the Password:
+	Authenticator   Authenticator // checks provider-auth, see LoadAuth
+	CredentialsPath string        // see LoadCredentials
+	TokenKeyPath    string        // see TokenAuth
+	MaxAuthAttempts int           // failed provider-auth per remote before lockout, -1 for no limit
+	AuthLockout     time.Duration // how long a remote is locked out
+	Roles           RoleMap       // roles of identities from the Authenticator
+	DefaultRole     Role          // role of identities not in Roles, admin if empty
+
+	// Send queues, for each connection, not used for standard I/O:
+	SendQueueSize    int               // max queued msgs, -1 to write synchronously
+	SendQueuePolicy  SendQueuePolicy   // when the queue is full, default disconnect
+	SendQueueMetrics *SendQueueMetrics // optional, see provider-stats
+
+	// Keepalive, not used for standard I/O:
+	HeartbeatInterval time.Duration // send pings this often, 0 to disable
+	IdleTimeout       time.Duration // close conns without input, 0 to disable
+	WriteTimeout      time.Duration // close conns stuck writing a msg, 0 to disable
 }
 
 func (opts *Options) useTLS() bool {
@@ -41,7 +74,11 @@ func (opts *Options) useTLS() bool {
 var DefaultOptions = Options{
 	MaxConns: 1,
 	//AutoPassword: true,
-	AutoExit: true,
+	AutoExit:        true,
+	MaxAuthAttempts: 5,
+	AuthLockout:     time.Minute,
+	SendQueueSize:   DefaultSendQueueSize,
+	SendQueuePolicy: SendQueueDisconnect,
 }
 
 // AddFlags adds flags for the options.
@@ -56,11 +93,80 @@ func (opts *Options) AddFlags(flags *flag.FlagSet) {
 		"Automatic password (first conn sets if not set yet)")
 	flags.BoolVar(&opts.AutoExit, "autoExit", opts.AutoExit,
 		"Automatically exit upon the last disconnection")
+	flags.StringVar(&opts.Encoding, "encoding", opts.Encoding,
+		"Set the wire encoding for provider connections: json or cbor")
+	flags.StringVar(&opts.LogDir, "logDir", opts.LogDir,
+		"Directory to record all published messages to a log")
+	flags.StringVar(&opts.RecordPath, "record", opts.RecordPath,
+		"Record the session to a file, for playback-provider")
 
 	flags.StringVar(&opts.CertPath, "cert", opts.CertPath,
 		"Path to TLS certificate file")
 	flags.StringVar(&opts.PrivateKeyPath, "privkey", opts.PrivateKeyPath,
 		"Path to TLS private key file")
+	flags.StringVar(&opts.ClientCAPath, "clientCA", opts.ClientCAPath,
+		"Path to CA certificates file, to require and verify TLS client certificates")
+	flags.BoolVar(&opts.ClientCertAuth, "clientCertAuth", opts.ClientCertAuth,
+		"Authenticate by the client certificate subject, instead of provider-auth")
+
+	flags.StringVar(&opts.SocketMode, "socketMode", opts.SocketMode,
+		"Octal permissions for the unix socket file, such as 0600")
+	flags.StringVar(&opts.PeerAuth, "peerAuth", opts.PeerAuth,
+		"Unix socket peer user IDs (comma separated, or self) which skip provider-auth")
+
+	flags.StringVar(&opts.CredentialsPath, "credentials", opts.CredentialsPath,
+		"Path to a file of name:hash credentials for provider-auth")
+	flags.StringVar(&opts.TokenKeyPath, "tokenKey", opts.TokenKeyPath,
+		"Path to a key file for signed provider-auth tokens")
+	flags.IntVar(&opts.MaxAuthAttempts, "maxAuthAttempts", opts.MaxAuthAttempts,
+		"Failed provider-auth attempts per remote before lockout, -1 for no limit")
+	flags.DurationVar(&opts.AuthLockout, "authLockout", opts.AuthLockout,
+		"How long a remote is locked out after too many failed provider-auth attempts")
+	flags.Var(&opts.Roles, "roles",
+		"Roles of provider-auth identities: name=role,... where role is admin, operator or observer")
+	flags.Var(&opts.DefaultRole, "defaultRole",
+		"Role of provider-auth identities not in -roles (default admin)")
+
+	flags.IntVar(&opts.SendQueueSize, "sendQueue", opts.SendQueueSize,
+		"Max queued messages for each connection, -1 to write synchronously")
+	flags.Var(&opts.SendQueuePolicy, "sendQueuePolicy",
+		"When a send queue is full: block, drop-oldest or disconnect")
+
+	flags.DurationVar(&opts.HeartbeatInterval, "heartbeat", opts.HeartbeatInterval,
+		"Send pings to connections this often, 0 to disable")
+	flags.DurationVar(&opts.IdleTimeout, "idleTimeout", opts.IdleTimeout,
+		"Close connections without input for this long, 0 to disable (use with -heartbeat)")
+	flags.DurationVar(&opts.WriteTimeout, "writeTimeout", opts.WriteTimeout,
+		"Close connections stuck writing a message for this long, 0 to disable")
+}
+
+// LoadAuth sets the Authenticator from CredentialsPath and TokenKeyPath,
+// in addition to any existing Authenticator.
+func (opts *Options) LoadAuth() error {
+	var auths MultiAuth
+	if opts.Authenticator != nil {
+		auths = append(auths, opts.Authenticator)
+	}
+	if opts.CredentialsPath != "" {
+		creds, err := LoadCredentials(opts.CredentialsPath)
+		if err != nil {
+			return err
+		}
+		auths = append(auths, creds)
+	}
+	if opts.TokenKeyPath != "" {
+		key, err := LoadTokenKey(opts.TokenKeyPath)
+		if err != nil {
+			return err
+		}
+		auths = append(auths, &TokenAuth{Key: key})
+	}
+	if len(auths) == 1 {
+		opts.Authenticator = auths[0]
+	} else if len(auths) > 1 {
+		opts.Authenticator = auths
+	}
+	return nil
 }
 
 // Serve will serve on the provided listener and options.
@@ -70,11 +176,35 @@ func Serve(ln net.Listener, opts Options, svc service.Servicer, tp service.Multi
 	return srv.Serve(ln)
 }
 
+// ServeIO serves the one connection of the stream, such as standard I/O.
+// Writes are synchronous, so all responses are written before EOF closes
+// the connection, and there are no other connections to hold up.
+func ServeIO(rwc io.ReadWriteCloser, opts Options, svc service.Servicer, tp service.MultiTransporter) error {
+	// Pipes do not go half-open, and the process exits upon EOF.
+	opts.HeartbeatInterval = 0
+	opts.IdleTimeout = 0
+	opts.WriteTimeout = 0
+	opts.SendQueueSize = -1
+	return Serve(server.ListenIO(rwc), opts, svc, tp)
+}
+
 func ListenAndServe(opts Options, svc service.Servicer, tp service.MultiTransporter) error {
+	if err := opts.checkClientCA(); err != nil {
+		return err
+	}
 	srv := newProvider(opts, svc, tp)
 	srv.Addr = opts.Addr
 	if opts.useTLS() {
-		return srv.ListenAndServeTLS(opts.CertPath, opts.PrivateKeyPath)
+		config, err := opts.tlsConfig()
+		if err != nil {
+			return err
+		}
+		ln, err := tls.Listen("tcp", opts.Addr, config)
+		if err != nil {
+			return err
+		}
+		defer ln.Close()
+		return srv.Serve(ln)
 	} else {
 		return srv.ListenAndServe()
 	}
@@ -103,14 +233,22 @@ func ListenAndServeWS(opts Options, svc service.Servicer, tp service.MultiTransp
 	default:
 		return errors.New("not a valid websocket addr")
 	}
+	if err := opts.checkClientCA(); err != nil {
+		return err
+	}
 
 	mux := &http.ServeMux{}
 	httpserver := &http.Server{
 		Addr:    u.Host,
 		Handler: mux,
 	}
-	wsln := wslisten.ListenWS()
-	wsln.DefaultFormat = wslisten.TextFormat
+	if opts.useTLS() {
+		httpserver.TLSConfig, err = opts.tlsConfig()
+		if err != nil {
+			return err
+		}
+	}
+	wsln := newWSListener()
 
 	pattern := u.Path
 	if pattern == "" {
@@ -125,7 +263,7 @@ func ListenAndServeWS(opts Options, svc service.Servicer, tp service.MultiTransp
 	go func() {
 		defer close(httpch)
 		if opts.useTLS() {
-			httpErr = httpserver.ListenAndServeTLS(opts.CertPath, opts.PrivateKeyPath)
+			httpErr = httpserver.ListenAndServeTLS("", "") // From TLSConfig.
 		} else {
 			httpErr = httpserver.ListenAndServe()
 		}
@@ -153,6 +291,31 @@ type provider struct {
 	mx               sync.RWMutex
 	password         string // locked by mx (in case of AutoPassword update)
 	passwordDisabled bool
+	throttle         *authThrottle
+}
+
+// Authenticate checks the provider-auth args from the remote,
+// using the Authenticator and the password.
+// Returns the identity, which is empty for the password.
+func (p *provider) Authenticate(remote string, args []string) (string, error) {
+	if p.throttle.locked(remote) {
+		return "", ErrAuthLocked
+	}
+	err := ErrAuthFailed
+	if p.opts.Authenticator != nil {
+		var identity string
+		identity, err = p.opts.Authenticator.Authenticate(args)
+		if err == nil {
+			p.throttle.succeed(remote)
+			return identity, nil
+		}
+	}
+	if len(args) == 1 && p.PasswordCheck(args[0]) {
+		p.throttle.succeed(remote)
+		return "", nil
+	}
+	p.throttle.fail(remote)
+	return "", err
 }
 
 // if opts.AutoPassword is true and the password hasn't been set yet,
@@ -164,10 +327,10 @@ func (p *provider) PasswordCheck(pw string) bool {
 	if p.passwordDisabled {
 		return false
 	}
-	if pw == p.password {
+	if p.password != "" && subtle.ConstantTimeCompare([]byte(pw), []byte(p.password)) == 1 {
 		return true
 	}
-	if p.password == "" && p.opts.AutoPassword {
+	if p.password == "" && p.opts.AutoPassword && p.opts.Authenticator == nil {
 		p.password = pw
 		return true
 	}
@@ -179,7 +342,7 @@ func (p *provider) PasswordCheck(pw string) bool {
 func (p *provider) PasswordCheckSkip() bool {
 	p.mx.Lock()
 	defer p.mx.Unlock()
-	if !p.opts.AutoPassword {
+	if !p.opts.AutoPassword || p.opts.Authenticator != nil {
 		return false
 	}
 	if p.passwordDisabled || p.password != "" {
@@ -190,20 +353,225 @@ func (p *provider) PasswordCheckSkip() bool {
 }
 
 type clientInfo struct {
-	p      *provider
-	tp     *connTransport // only added to the multi tp if authed.
-	authed bool
+	p        *provider
+	tp       *connTransport // only added to the multi tp if authed.
+	authed   bool
+	identity string // from the Authenticator or client cert, if any.
+	role     Role   // set when authed.
+
+	stopHeartbeat chan struct{} // nil if no heartbeat.
+	remote        string        // for throttling provider-auth.
+	certDone      chan struct{} // closed by checkCert, nil if not checking.
+}
+
+// checkCert gets the identity from the verified client cert,
+// authenticating if ClientCertAuth. It runs in its own goroutine,
+// call waitCert before using authed, identity or role.
+func (cinfo *clientInfo) checkCert(conn net.Conn, tp service.MultiTransporter) {
+	defer close(cinfo.certDone)
+	cinfo.identity = connCertIdentity(conn)
+	cinfo.touch() // The handshake cleared the deadline.
+	if !cinfo.authed && cinfo.p.opts.ClientCertAuth && cinfo.identity != "" {
+		cinfo.authed = true
+		cinfo.role = cinfo.p.opts.roleFor(cinfo.identity)
+		tp.AddTransport(cinfo.tp)
+		cinfo.startHeartbeat()
+	}
+}
+
+// waitCert waits for checkCert to finish, if it was started.
+func (cinfo *clientInfo) waitCert() {
+	if cinfo.certDone != nil {
+		<-cinfo.certDone
+		cinfo.certDone = nil
+	}
 }
 
 var clientInfoKey = &ctxKey{"*clientInfo"}
 
+// cmdEncoding changes this client's wire encoding, see stdchat.GetCodec.
+// The response is sent in the previous encoding, then the encoding changes.
+// The response is always sent, regardless of the topic subscriptions.
+func (cinfo *clientInfo) cmdEncoding(msg *stdchat.CmdMsg) {
+	if len(msg.Args) < 1 {
+		cinfo.tp.writeError(msg.ID, errors.New("unexpected command args"))
+		return
+	}
+	codec := stdchat.GetCodec(msg.Args[0])
+	if codec == nil {
+		cinfo.tp.writeError(msg.ID, errors.New("unknown encoding: "+msg.Args[0]))
+		return
+	}
+	outmsg := &stdchat.BaseMsg{}
+	outmsg.Init(msg.ID, "info/provider.encoding", cinfo.tp.GetProtocol())
+	outmsg.Message.SetText(msg.Args[0])
+	cinfo.tp.write(&stdchat.Envelope{
+		Topic:   stdchat.Topic{Protocol: cinfo.tp.Protocol, Node: "info/provider.encoding"},
+		Payload: outmsg,
+	})
+	cinfo.tp.SetCodec(codec)
+}
+
+// cmdTopics changes this client's topic subscriptions, see stdchat.MatchTopic.
+// The response is always sent, regardless of the subscriptions.
+func (cinfo *clientInfo) cmdTopics(msg *stdchat.CmdMsg) {
+	var topics []string
+	if msg.Command == "subscribe-topics" {
+		for _, pattern := range msg.Args {
+			if !stdchat.ValidTopicPattern(pattern) {
+				cinfo.tp.writeError(msg.ID, errors.New("invalid topic pattern: "+pattern))
+				return
+			}
+		}
+		topics = cinfo.tp.SubscribeTopics(msg.Args...)
+	} else {
+		topics = cinfo.tp.UnsubscribeTopics(msg.Args...)
+	}
+	outmsg := &stdchat.BaseMsg{}
+	outmsg.Init(msg.ID, "info/provider.topics", cinfo.tp.GetProtocol())
+	outmsg.Message.SetText(strings.Join(topics, " "))
+	cinfo.tp.write(&stdchat.Envelope{
+		Topic:   stdchat.Topic{Protocol: cinfo.tp.Protocol, Node: "info/provider.topics"},
+		Payload: outmsg,
+	})
+}
+
+// cmdAcceptFormats adds to the msg formats accepted by this client,
+// see service.FillFormats. Responds with all the accepted formats.
+func (cinfo *clientInfo) cmdAcceptFormats(msg *stdchat.CmdMsg) {
+	cinfo.tp.AcceptFormats(msg.Args...)
+	outmsg := &stdchat.BaseMsg{}
+	outmsg.Init(msg.ID, "info/provider.formats", cinfo.tp.GetProtocol())
+	outmsg.Message.SetText(strings.Join(cinfo.tp.AcceptedFormats(), " "))
+	cinfo.tp.write(&stdchat.Envelope{
+		Topic:   stdchat.Topic{Protocol: cinfo.tp.Protocol, Node: "info/provider.formats"},
+		Payload: outmsg,
+	})
+}
+
+// cmdStats sends this client info/provider.stats with the send queue stats.
+func (cinfo *clientInfo) cmdStats(msg *stdchat.CmdMsg) {
+	outmsg := &stdchat.BaseMsg{}
+	outmsg.Init(msg.ID, "info/provider.stats", cinfo.tp.GetProtocol())
+	outmsg.Message.SetText(cinfo.p.opts.SendQueueMetrics.Stats().String())
+	cinfo.tp.write(&stdchat.Envelope{
+		Topic:   stdchat.Topic{Protocol: cinfo.tp.Protocol, Node: "info/provider.stats"},
+		Payload: outmsg,
+	})
+}
+
+// resumer is implemented by service.SeqTransport
+type resumer interface {
+	Replay(after uint64, fn func(env *stdchat.Envelope) error) error
+}
+
+// cmdResume sends this client the msgs after the sequence number in the args,
+// which were missed before connecting, followed by info/provider.resume
+// If the msgs are no longer available, info/provider.resync is sent instead,
+// the client should then use get-state.
+func (cinfo *clientInfo) cmdResume(msg *stdchat.CmdMsg, tp service.MultiTransporter) {
+	if len(msg.Args) < 1 {
+		cinfo.tp.writeError(msg.ID, errors.New("unexpected command args"))
+		return
+	}
+	after, err := strconv.ParseUint(msg.Args[0], 10, 64)
+	if err != nil {
+		cinfo.tp.writeError(msg.ID, errors.New("invalid sequence number: "+msg.Args[0]))
+		return
+	}
+	rtp, ok := tp.(resumer)
+	if !ok {
+		cinfo.tp.writeError(msg.ID, errors.New("resume not supported"))
+		return
+	}
+	// Msgs published during the replay are sent after it, in order.
+	cinfo.tp.hold()
+	defer cinfo.tp.release()
+	node := "info/provider.resume"
+	n := 0
+	err = rtp.Replay(after, func(env *stdchat.Envelope) error {
+		if !cinfo.tp.needsReplay(env) {
+			return nil
+		}
+		n++
+		return cinfo.tp.writeWait(env) // Not dropped for a full queue.
+	})
+	if err == service.ErrSeqNotFound {
+		node = "info/provider.resync"
+	} else if err != nil {
+		cinfo.tp.writeError(msg.ID, err)
+		return
+	}
+	outmsg := &stdchat.BaseMsg{}
+	outmsg.Init(msg.ID, node, cinfo.tp.GetProtocol())
+	if node == "info/provider.resync" {
+		outmsg.Message.SetText("missed too many messages, use get-state")
+	} else {
+		outmsg.Message.SetText(strconv.Itoa(n))
+	}
+	cinfo.tp.write(&stdchat.Envelope{
+		Topic:   stdchat.Topic{Protocol: cinfo.tp.Protocol, Node: node},
+		Payload: outmsg,
+	})
+}
+
+// getConnCmd returns the msg if it is one of the commands, otherwise nil.
+// These commands are handled by the provider for the conn,
+// commands to a network are left to the service.
+func getConnCmd(data []byte, commands ...string) *stdchat.CmdMsg {
+	found := false
+	for _, cmd := range commands {
+		if bytes.Index(data, []byte(`"`+cmd+`"`)) != -1 {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil
+	}
+	msg := &stdchat.CmdMsg{}
+	if err := stdchat.DecodeMsg(data, msg); err != nil {
+		return nil
+	}
+	if !msg.IsType("cmd") || msg.Network.ID != "" {
+		return nil
+	}
+	for _, cmd := range commands {
+		if msg.Command == cmd {
+			return msg
+		}
+	}
+	return nil
+}
+
 func newProvider(opts Options, svc service.Servicer, tp service.MultiTransporter) *provider {
 	if opts.MaxConns == 0 {
 		opts.MaxConns = 1
 	}
+	codec := stdchat.GetCodec(opts.Encoding)
+	if codec == nil {
+		log.Printf("unknown encoding %s, using json", opts.Encoding)
+		codec = stdchat.JSON
+	}
+	if opts.MaxAuthAttempts == 0 {
+		opts.MaxAuthAttempts = DefaultOptions.MaxAuthAttempts
+	}
+	if opts.AuthLockout <= 0 {
+		opts.AuthLockout = DefaultOptions.AuthLockout
+	}
+	if opts.SendQueueSize == 0 {
+		opts.SendQueueSize = DefaultSendQueueSize
+	}
+	if opts.SendQueuePolicy == "" {
+		opts.SendQueuePolicy = SendQueueDisconnect
+	}
+	if opts.SendQueueMetrics == nil {
+		opts.SendQueueMetrics = &SendQueueMetrics{}
+	}
 	p := &provider{
 		opts:     opts,
 		password: opts.Password,
+		throttle: newAuthThrottle(opts.MaxAuthAttempts, opts.AuthLockout),
 	}
 	var srv *server.Server
 	srv = &server.Server{
@@ -211,11 +579,27 @@ func newProvider(opts Options, svc service.Servicer, tp service.MultiTransporter
 			return svc.Context()
 		},
 		NewConn: func(ctx context.Context, conn net.Conn) context.Context {
-			wantServiceAuth := opts.AutoPassword || opts.Password != ""
+			wantServiceAuth := opts.AutoPassword || opts.Password != "" ||
+				opts.PeerAuth != "" || opts.Authenticator != nil || opts.ClientCertAuth
 			cinfo := &clientInfo{
 				p:      p,
-				tp:     &connTransport{conn: conn},
-				authed: !wantServiceAuth,
+				tp:     newConnTransport(tp.GetProtocol(), conn),
+				authed: !wantServiceAuth || peerAllowed(&opts, conn),
+				remote: remoteKey(conn),
+			}
+			authed := cinfo.authed // checkCert can change cinfo.authed.
+			if authed {
+				cinfo.role = RoleAdmin
+			}
+			cinfo.tp.SetCodec(codec)
+			cinfo.tp.writeTimeout = opts.WriteTimeout
+			if opts.SendQueueSize > 0 {
+				cinfo.tp.queue = newSendQueue(conn, opts.SendQueueSize,
+					opts.SendQueuePolicy, opts.SendQueueMetrics, opts.WriteTimeout)
+			}
+			cinfo.touch() // Not extended until authed.
+			if authed {
+				cinfo.startHeartbeat()
 			}
 			err := cinfo.tp.Advertise()
 			if err != nil {
@@ -225,7 +609,12 @@ func newProvider(opts Options, svc service.Servicer, tp service.MultiTransporter
 			if opts.MaxConns == 1 && opts.AutoExit {
 				srv.MaxConns = -1 // No new conns after this.
 			}
-			if cinfo.authed {
+			if opts.ClientCAPath != "" {
+				// Not in the accept loop, the TLS handshake can take a while.
+				cinfo.certDone = make(chan struct{})
+				go cinfo.checkCert(conn, tp)
+			}
+			if authed {
 				tp.AddTransport(cinfo.tp)
 			}
 			return ctx
@@ -237,11 +626,25 @@ func newProvider(opts Options, svc service.Servicer, tp service.MultiTransporter
 					log.Println("provider Handler ctx does not contain clientInfoKey")
 					return
 				}
+				cinfo.waitCert()
+				data := r.Data
+				if stdchat.IsCBOR(data) {
+					var err error
+					data, err = stdchat.CBORToJSON(data)
+					if err != nil {
+						cinfo.tp.writeError("", err)
+						return
+					}
+				}
+				if msg := getConnCmd(data, "provider-encoding"); msg != nil {
+					cinfo.cmdEncoding(msg)
+					return
+				}
 				if !cinfo.authed { // Not authed yet.
 					// Note: while not authed, any responses (including errors)
 					// should go to cinfo.tp directly, NOT tp or svc.GenericError!
 					msg := &stdchat.CmdMsg{}
-					if err := stdchat.DecodeMsg(r.Data, msg); err != nil {
+					if err := stdchat.DecodeMsg(data, msg); err != nil {
 						cinfo.tp.PublishError(msg.ID, msg.Network.ID, err)
 						return
 					}
@@ -256,21 +659,29 @@ func newProvider(opts Options, svc service.Servicer, tp service.MultiTransporter
 							cinfo.tp.PublishError(msg.ID, msg.Network.ID, err)
 							return
 						}
-						if !cinfo.p.PasswordCheck(msg.Args[0]) {
-							err := errors.New("authentication failed")
+						identity, err := cinfo.p.Authenticate(cinfo.remote, msg.Args)
+						if err != nil {
 							cinfo.tp.PublishError(msg.ID, msg.Network.ID, err)
 							return
 						}
 						cinfo.authed = true
+						if identity != "" || cinfo.identity == "" {
+							cinfo.identity = identity
+						} // else keep the client cert identity.
+						cinfo.role = opts.roleFor(cinfo.identity)
 						tp.AddTransport(cinfo.tp)
+						cinfo.touch()
+						cinfo.startHeartbeat()
 						outmsg := &stdchat.BaseMsg{}
-						outmsg.Init(msg.ID, "", tp.GetProtocol())
-						outmsg.Message.SetText("authenticated")
+						outmsg.Init(msg.ID, "info/provider.auth", tp.GetProtocol())
+						outmsg.Message.SetText("authenticated as " + string(cinfo.role))
 						cinfo.tp.Publish(msg.Network.ID, "", "info/provider.auth", &outmsg)
 						return
 					} else if cinfo.p.PasswordCheckSkip() {
 						cinfo.authed = true
+						cinfo.role = RoleAdmin
 						tp.AddTransport(cinfo.tp)
+						cinfo.startHeartbeat()
 						// Fall through and process the current message.
 					} else {
 						err := errors.New("must authenticate with the provider first (provider-auth)")
@@ -278,7 +689,35 @@ func newProvider(opts Options, svc service.Servicer, tp service.MultiTransporter
 						return
 					}
 				}
-				if err := service.DispatchMsg(svc, r.Data); err != nil {
+				cinfo.touch()
+				if msg := getConnCmd(data, "provider-pong"); msg != nil {
+					return // Only needed for the idle timeout.
+				}
+				if msg := getConnCmd(data, "subscribe-topics", "unsubscribe-topics"); msg != nil {
+					cinfo.cmdTopics(msg)
+					return
+				}
+				if msg := getConnCmd(data, "accept-formats"); msg != nil {
+					cinfo.cmdAcceptFormats(msg)
+					return
+				}
+				if msg := getConnCmd(data, "provider-stats"); msg != nil {
+					cinfo.cmdStats(msg)
+					return
+				}
+				if msg := getConnCmd(data, "resume"); msg != nil {
+					cinfo.cmdResume(msg, tp)
+					return
+				}
+				if cinfo.role != RoleAdmin {
+					msg := &stdchat.CmdMsg{}
+					stdchat.DecodeMsg(data, msg) // Errors are left to DispatchMsg.
+					if err := cinfo.role.check(msg); err != nil {
+						cinfo.tp.writeError(msg.ID, err)
+						return
+					}
+				}
+				if err := service.DispatchMsg(svc, data); err != nil {
 					svc.GenericError(err)
 					return
 				}
@@ -286,20 +725,32 @@ func newProvider(opts Options, svc service.Servicer, tp service.MultiTransporter
 		}),
 		ConnClosed: func(ctx context.Context, conn net.Conn, err error) {
 			if err != nil {
-				svc.GenericError(err)
+				if isTimeout(err) {
+					log.Printf("provider connection idle timeout: %v", err)
+				} else {
+					svc.GenericError(err)
+				}
 			}
 			cinfo, _ := ctx.Value(clientInfoKey).(*clientInfo)
 			if cinfo == nil {
 				log.Println("provider ConnClosed ctx does not contain clientInfoKey")
 			} else {
+				cinfo.waitCert() // The conn is closed, so not for long.
 				tp.RemoveTransport(cinfo.tp)
+				if cinfo.tp.queue != nil {
+					cinfo.tp.queue.close()
+				}
+				if cinfo.stopHeartbeat != nil {
+					close(cinfo.stopHeartbeat)
+				}
 			}
 			if srv.NumConns() == 0 && opts.AutoExit {
 				srv.Close() // Auto exit.
 				svc.Close()
 			}
 		},
-		MaxConns: opts.MaxConns,
+		ConnSplit: stdchat.ScanMsgs, // CBOR items can contain newlines.
+		MaxConns:  opts.MaxConns,
 	}
 	p.Server = srv
 	return p
@@ -310,11 +761,39 @@ func Run(protocol string, newService func(t service.Transporter) service.Service
 	opts := DefaultOptions
 	opts.AddFlags(flag.CommandLine)
 	flag.Parse()
+	if err := opts.LoadAuth(); err != nil {
+		return err
+	}
 
-	t := &service.MultiTransport{
+	mt := &service.MultiTransport{
 		Protocol: protocol,
 	}
+	// Sequence numbers for resume, see cmdResume.
+	t := &service.SeqTransport{MultiTransporter: mt}
+	if opts.LogDir != "" {
+		t.Log = &service.LogTransport{Protocol: protocol, Dir: opts.LogDir}
+		if err := t.Log.Advertise(); err != nil {
+			return err
+		}
+	}
+	var rec *service.Recorder
+	if opts.RecordPath != "" {
+		f, err := os.Create(opts.RecordPath)
+		if err != nil {
+			return err
+		}
+		rec = &service.Recorder{Protocol: protocol, W: f}
+		defer rec.Close()
+		if err := rec.Advertise(); err != nil {
+			return err
+		}
+		mt.AddTransport(rec)
+	}
+	// The msg formats accepted by clients are filled in for each conn.
 	svc := newService(t)
+	if rec != nil {
+		svc = &service.RecordService{Servicer: svc, Recorder: rec}
+	}
 	err := t.Advertise()
 	if err != nil {
 		return err
@@ -324,12 +803,15 @@ func Run(protocol string, newService func(t service.Transporter) service.Service
 		if opts.useTLS() {
 			return errors.New("Do not use cert/privkey with standard I/O")
 		}
+		if err := opts.checkClientCA(); err != nil {
+			return err
+		}
 		stdio := &struct {
 			io.Reader
 			io.WriteCloser
 		}{os.Stdin, os.Stdout}
 		os.Stdout = os.Stderr // Anything going to Go's os.Stdout will go to stderr.
-		err := Serve(server.ListenIO(stdio), opts, svc, t)
+		err := ServeIO(stdio, opts, svc, t)
 		if err != nil && err != server.ErrServerClosed {
 			return err
 		}
@@ -338,6 +820,21 @@ func Run(protocol string, newService func(t service.Transporter) service.Service
 		if err != nil && err != server.ErrServerClosed {
 			return err
 		}
+	} else if strings.HasPrefix(opts.Addr, "unix:") {
+		err := ListenAndServeUnix(opts, svc, t)
+		if err != nil && err != server.ErrServerClosed {
+			return err
+		}
+	} else if strings.HasPrefix(opts.Addr, "systemd:") {
+		err := ListenAndServeSystemd(opts, svc, t)
+		if err != nil && err != server.ErrServerClosed {
+			return err
+		}
+	} else if strings.HasPrefix(opts.Addr, "http:") || strings.HasPrefix(opts.Addr, "https:") {
+		err := ListenAndServeSSE(opts, svc, t)
+		if err != nil && err != server.ErrServerClosed {
+			return err
+		}
 	} else {
 		err := ListenAndServe(opts, svc, t)
 		if err != nil && err != server.ErrServerClosed {
@@ -347,9 +844,115 @@ func Run(protocol string, newService func(t service.Transporter) service.Service
 	return nil
 }
 
+var _ service.FormatAccepter = &connTransport{}
+
 type connTransport struct {
 	service.LocalTransport
-	conn net.Conn
+	conn     net.Conn
+	codec    atomic.Value // connCodec
+	mx       sync.RWMutex
+	topics   []string            // topic patterns, or nil for all; locked by mx
+	accept   []string            // accepted msg formats, see accept-formats; locked by mx
+	firstSeq uint64              // first sequence number published, locked by mx
+	holding  bool                // hold published msgs, see hold; locked by mx
+	held     []*stdchat.Envelope // locked by mx
+	queue    *sendQueue          // nil to write synchronously.
+	// writeTimeout is the write deadline, if set.
+	writeTimeout time.Duration
+}
+
+func newConnTransport(protocol string, conn net.Conn) *connTransport {
+	tp := &connTransport{conn: conn}
+	tp.Protocol = protocol
+	return tp
+}
+
+type connCodec struct {
+	stdchat.Codec
+}
+
+// SetCodec sets the wire encoding for this conn.
+func (tp *connTransport) SetCodec(codec stdchat.Codec) {
+	tp.codec.Store(connCodec{codec})
+}
+
+func (tp *connTransport) getCodec() stdchat.Codec {
+	if x, ok := tp.codec.Load().(connCodec); ok {
+		return x.Codec
+	}
+	return stdchat.JSON
+}
+
+// SubscribeTopics adds topic patterns, returns the current patterns.
+// Only msgs with topics matching a pattern are sent, once subscribed.
+func (tp *connTransport) SubscribeTopics(patterns ...string) []string {
+	tp.mx.Lock()
+	defer tp.mx.Unlock()
+	for _, pattern := range patterns {
+		found := false
+		for _, x := range tp.topics {
+			if x == pattern {
+				found = true
+				break
+			}
+		}
+		if !found {
+			tp.topics = append(tp.topics, pattern)
+		}
+	}
+	return append([]string(nil), tp.topics...)
+}
+
+// UnsubscribeTopics removes topic patterns, or all if none specified.
+// Returns the current patterns.
+// All msgs are sent if there are no patterns.
+func (tp *connTransport) UnsubscribeTopics(patterns ...string) []string {
+	tp.mx.Lock()
+	defer tp.mx.Unlock()
+	if len(patterns) == 0 {
+		tp.topics = nil
+	}
+	for _, pattern := range patterns {
+		for i, x := range tp.topics {
+			if x == pattern {
+				tp.topics = append(tp.topics[:i], tp.topics[i+1:]...)
+				break
+			}
+		}
+	}
+	if len(tp.topics) == 0 {
+		tp.topics = nil
+	}
+	return append([]string(nil), tp.topics...)
+}
+
+// AcceptFormats adds to the msg formats accepted by this conn.
+func (tp *connTransport) AcceptFormats(msgTypes ...string) {
+	tp.mx.Lock()
+	defer tp.mx.Unlock()
+	tp.accept = service.AddFormats(tp.accept, msgTypes...)
+}
+
+func (tp *connTransport) AcceptedFormats() []string {
+	tp.mx.RLock()
+	defer tp.mx.RUnlock()
+	return append([]string(nil), tp.accept...)
+}
+
+// isSubscribed returns true if the topic matches the subscriptions.
+func (tp *connTransport) isSubscribed(topic stdchat.Topic) bool {
+	tp.mx.RLock()
+	defer tp.mx.RUnlock()
+	if tp.topics == nil {
+		return true
+	}
+	name := topic.String()
+	for _, pattern := range tp.topics {
+		if stdchat.MatchTopic(pattern, name) {
+			return true
+		}
+	}
+	return false
 }
 
 func (tp *connTransport) Advertise() error {
@@ -365,13 +968,111 @@ func (tp *connTransport) Advertise() error {
 }
 
 func (tp *connTransport) publish(network, chat, node string, payload interface{}) error {
-	j, err := stdchat.JSON.Marshal(&struct {
-		Node    string      `json:"node"`
-		Payload interface{} `json:"payload"`
-	}{node, payload})
+	return tp.PublishSeq(0, network, chat, node, payload)
+}
+
+func (tp *connTransport) PublishSeq(seq uint64, network, chat, node string, payload interface{}) error {
+	topic := stdchat.Topic{Protocol: tp.Protocol, Network: network, Chat: chat, Node: node}
+	if seq != 0 {
+		tp.mx.Lock()
+		if tp.firstSeq == 0 {
+			tp.firstSeq = seq
+		}
+		tp.mx.Unlock()
+	}
+	if !tp.isSubscribed(topic) {
+		return nil
+	}
+	env := &stdchat.Envelope{Topic: topic, Seq: seq, Payload: payload}
+	tp.mx.Lock()
+	if tp.holding {
+		tp.held = append(tp.held, env)
+		tp.mx.Unlock()
+		return nil
+	}
+	tp.mx.Unlock()
+	return tp.write(env)
+}
+
+// hold holds published msgs until release, such as during a replay.
+func (tp *connTransport) hold() {
+	tp.mx.Lock()
+	defer tp.mx.Unlock()
+	tp.holding = true
+}
+
+// release writes the held msgs, and stops holding.
+func (tp *connTransport) release() {
+	for {
+		tp.mx.Lock()
+		held := tp.held
+		tp.held = nil
+		if len(held) == 0 {
+			tp.holding = false
+			tp.mx.Unlock()
+			return
+		}
+		tp.mx.Unlock()
+		for _, env := range held {
+			tp.write(env)
+		}
+	}
+}
+
+// needsReplay returns true if the replayed msg was not already published (or held)
+// to this conn, and matches the topic subscriptions.
+func (tp *connTransport) needsReplay(env *stdchat.Envelope) bool {
+	tp.mx.RLock()
+	firstSeq := tp.firstSeq
+	tp.mx.RUnlock()
+	if firstSeq != 0 && env.Seq >= firstSeq {
+		return false
+	}
+	return tp.isSubscribed(env.Topic)
+}
+
+// writeError writes an error msg regardless of the topic subscriptions.
+func (tp *connTransport) writeError(id string, err error) error {
+	msg := &stdchat.NetMsg{}
+	msg.Init(id, "error", tp.Protocol, "")
+	msg.Message.SetText(err.Error())
+	return tp.write(&stdchat.Envelope{
+		Topic:   stdchat.Topic{Protocol: tp.Protocol, Node: "error"},
+		Payload: msg,
+	})
+}
+
+// write the envelope to the conn, regardless of the topic subscriptions.
+// The msg is queued if there is a send queue, see SendQueuePolicy.
+func (tp *connTransport) write(env *stdchat.Envelope) error {
+	return tp.writeEnvelope(env, false)
+}
+
+// writeWait is like write, but waits for room if the send queue is full.
+func (tp *connTransport) writeWait(env *stdchat.Envelope) error {
+	return tp.writeEnvelope(env, true)
+}
+
+func (tp *connTransport) writeEnvelope(env *stdchat.Envelope, wait bool) error {
+	codec := tp.getCodec()
+	if accept := tp.AcceptedFormats(); len(accept) != 0 {
+		x := *env // The env and payload can be shared with other conns.
+		x.Payload = service.FillFormats(x.Payload, accept)
+		env = &x
+	}
+	b, err := stdchat.EncodeEnvelope(env, codec)
 	if err != nil {
 		return err
 	}
-	_, err = tp.conn.Write(append(j, '\n'))
+	if codec == stdchat.JSON {
+		b = append(b, '\n') // Newline-delimited JSON; CBOR is self-delimiting.
+	}
+	if tp.queue != nil {
+		return tp.queue.push(b, wait)
+	}
+	if tp.writeTimeout > 0 {
+		tp.conn.SetWriteDeadline(time.Now().Add(tp.writeTimeout))
+	}
+	_, err = tp.conn.Write(b)
 	return err
 }
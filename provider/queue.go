@@ -0,0 +1,192 @@
+package provider
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SendQueuePolicy is what to do when a connection's send queue is full.
+type SendQueuePolicy string
+
+const (
+	// SendQueueBlock waits for room in the queue,
+	// which delays publishing to all the other connections.
+	SendQueueBlock SendQueuePolicy = "block"
+	// SendQueueDropOldest drops the oldest queued msg.
+	SendQueueDropOldest SendQueuePolicy = "drop-oldest"
+	// SendQueueDisconnect closes the connection, the client can resume.
+	SendQueueDisconnect SendQueuePolicy = "disconnect"
+)
+
+const DefaultSendQueueSize = 256
+
+var ErrSlowConsumer = errors.New("send queue full, disconnecting slow consumer")
+
+var errSendQueueClosed = errors.New("send queue closed")
+
+func (policy SendQueuePolicy) String() string {
+	return string(policy)
+}
+
+// Set implements flag.Value
+func (policy *SendQueuePolicy) Set(s string) error {
+	switch x := SendQueuePolicy(s); x {
+	case SendQueueBlock, SendQueueDropOldest, SendQueueDisconnect:
+		*policy = x
+		return nil
+	}
+	return errors.New("unknown send queue policy: " + s)
+}
+
+// SendQueueStats are metrics of the send queues of all the connections.
+type SendQueueStats struct {
+	Depth        int64 // msgs queued now, across all connections.
+	MaxDepth     int64 // the most msgs queued for one connection.
+	Dropped      int64 // msgs dropped by SendQueueDropOldest.
+	Disconnected int64 // connections closed by SendQueueDisconnect.
+}
+
+func (stats SendQueueStats) String() string {
+	return "depth=" + strconv.FormatInt(stats.Depth, 10) +
+		" maxDepth=" + strconv.FormatInt(stats.MaxDepth, 10) +
+		" dropped=" + strconv.FormatInt(stats.Dropped, 10) +
+		" disconnected=" + strconv.FormatInt(stats.Disconnected, 10)
+}
+
+// SendQueueMetrics collects the SendQueueStats, see Options.
+// It is thread safe.
+type SendQueueMetrics struct {
+	depth, maxDepth, dropped, disconnected int64 // atomic
+}
+
+// Stats gets the current stats.
+func (m *SendQueueMetrics) Stats() SendQueueStats {
+	return SendQueueStats{
+		Depth:        atomic.LoadInt64(&m.depth),
+		MaxDepth:     atomic.LoadInt64(&m.maxDepth),
+		Dropped:      atomic.LoadInt64(&m.dropped),
+		Disconnected: atomic.LoadInt64(&m.disconnected),
+	}
+}
+
+func (m *SendQueueMetrics) queued(depth int) {
+	atomic.AddInt64(&m.depth, 1)
+	for {
+		max := atomic.LoadInt64(&m.maxDepth)
+		if int64(depth) <= max ||
+			atomic.CompareAndSwapInt64(&m.maxDepth, max, int64(depth)) {
+			break
+		}
+	}
+}
+
+// sendQueue is a bounded queue of encoded msgs for a conn,
+// written to the conn by its own goroutine.
+type sendQueue struct {
+	conn    net.Conn
+	size    int
+	policy  SendQueuePolicy
+	metrics *SendQueueMetrics
+	// writeTimeout is the write deadline, if set.
+	writeTimeout time.Duration
+	mx           sync.Mutex
+	cond         *sync.Cond // signaled upon changes to items and closed.
+	items        [][]byte   // locked by mx
+	closed       bool       // locked by mx
+}
+
+func newSendQueue(conn net.Conn, size int, policy SendQueuePolicy,
+	metrics *SendQueueMetrics, writeTimeout time.Duration) *sendQueue {
+	q := &sendQueue{
+		conn:         conn,
+		size:         size,
+		policy:       policy,
+		metrics:      metrics,
+		writeTimeout: writeTimeout,
+	}
+	q.cond = sync.NewCond(&q.mx)
+	go q.writer()
+	return q
+}
+
+// push queues the msg, applying the policy if the queue is full,
+// or waiting for room if block is true.
+func (q *sendQueue) push(b []byte, block bool) error {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	policy := q.policy
+	if block {
+		policy = SendQueueBlock
+	}
+	for !q.closed && len(q.items) >= q.size {
+		switch policy {
+		case SendQueueDropOldest:
+			q.items[0] = nil
+			q.items = q.items[1:]
+			atomic.AddInt64(&q.metrics.depth, -1)
+			atomic.AddInt64(&q.metrics.dropped, 1)
+		case SendQueueBlock:
+			q.cond.Wait()
+		default: // SendQueueDisconnect
+			atomic.AddInt64(&q.metrics.disconnected, 1)
+			q.closeLocked()
+			q.conn.Close()
+			return ErrSlowConsumer
+		}
+	}
+	if q.closed {
+		return errSendQueueClosed
+	}
+	q.items = append(q.items, b)
+	q.metrics.queued(len(q.items))
+	q.cond.Broadcast()
+	return nil
+}
+
+func (q *sendQueue) writer() {
+	for {
+		q.mx.Lock()
+		for !q.closed && len(q.items) == 0 {
+			q.cond.Wait()
+		}
+		if q.closed {
+			q.mx.Unlock()
+			return
+		}
+		b := q.items[0]
+		q.items[0] = nil
+		q.items = q.items[1:]
+		atomic.AddInt64(&q.metrics.depth, -1)
+		q.cond.Broadcast() // Room for blocked pushes.
+		q.mx.Unlock()
+		if q.writeTimeout > 0 {
+			q.conn.SetWriteDeadline(time.Now().Add(q.writeTimeout))
+		}
+		if _, err := q.conn.Write(b); err != nil {
+			q.close()
+			q.conn.Close() // The server reports the error.
+			return
+		}
+	}
+}
+
+// closeLocked discards the queued msgs, call with mx locked.
+func (q *sendQueue) closeLocked() {
+	if q.closed {
+		return
+	}
+	q.closed = true
+	atomic.AddInt64(&q.metrics.depth, -int64(len(q.items)))
+	q.items = nil
+	q.cond.Broadcast()
+}
+
+func (q *sendQueue) close() {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	q.closeLocked()
+}
@@ -0,0 +1,132 @@
+package provider
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"stdchat.org"
+)
+
+// Role is the access of a provider connection, given at provider-auth.
+// Connections authenticated without an identity (by the password,
+// peer auth or no auth required) are admins.
+type Role string
+
+const (
+	RoleAdmin    Role = "admin"    // can do everything.
+	RoleOperator Role = "operator" // can chat, but not login, logout or raw.
+	RoleObserver Role = "observer" // receives msgs, but cannot send.
+)
+
+// ParseRole parses a role name.
+func ParseRole(s string) (Role, error) {
+	switch role := Role(s); role {
+	case RoleAdmin, RoleOperator, RoleObserver:
+		return role, nil
+	}
+	return "", errors.New("unknown role: " + s)
+}
+
+func (role Role) String() string {
+	return string(role)
+}
+
+// Set implements flag.Value
+func (role *Role) Set(s string) error {
+	x, err := ParseRole(s)
+	if err != nil {
+		return err
+	}
+	*role = x
+	return nil
+}
+
+// observerCmds are the commands an observer can use,
+// besides the connection commands handled by the provider.
+var observerCmds = []string{"get-state", "ping"}
+
+// operatorDeniedCmds are the commands an operator cannot use.
+var operatorDeniedCmds = []string{"login", "logout", "raw"}
+
+// check returns an error if the role does not allow the input msg,
+// msg is decoded as a CmdMsg even if it is not a command.
+func (role Role) check(msg *stdchat.CmdMsg) error {
+	if role == RoleAdmin {
+		return nil
+	}
+	command := ""
+	if msg.IsType("cmd") {
+		command = msg.Command
+	}
+	switch role {
+	case RoleOperator:
+		if command != "" && containsString(operatorDeniedCmds, command) {
+			return errors.New("permission denied: operator cannot " + command)
+		}
+		return nil
+	case RoleObserver:
+		if command != "" && containsString(observerCmds, command) {
+			return nil
+		}
+		return errors.New("permission denied: observer cannot send")
+	}
+	return errors.New("permission denied")
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// RoleMap is the roles of identities, see Authenticator.
+// As a flag.Value it is a comma separated list of name=role
+type RoleMap map[string]Role
+
+func (rm *RoleMap) String() string {
+	var list []string
+	for name, role := range *rm {
+		list = append(list, name+"="+string(role))
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+func (rm *RoleMap) Set(s string) error {
+	m := make(RoleMap)
+	for _, x := range strings.Split(s, ",") {
+		x = strings.TrimSpace(x)
+		if x == "" {
+			continue
+		}
+		i := strings.IndexByte(x, '=')
+		if i <= 0 {
+			return errors.New("expected name=role")
+		}
+		role, err := ParseRole(x[i+1:])
+		if err != nil {
+			return err
+		}
+		m[x[:i]] = role
+	}
+	*rm = m
+	return nil
+}
+
+// roleFor gets the role for the identity from provider-auth or the client cert.
+func (opts *Options) roleFor(identity string) Role {
+	if identity == "" {
+		return RoleAdmin
+	}
+	if role, ok := opts.Roles[identity]; ok {
+		return role
+	}
+	if opts.DefaultRole != "" {
+		return opts.DefaultRole
+	}
+	return RoleAdmin
+}
@@ -0,0 +1,528 @@
+package provider
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"stdchat.org"
+	"stdchat.org/service"
+)
+
+// Server-sent events: each session is a provider conn.
+// GET starts a new session as a text/event-stream,
+// the first event is of type session with the session ID as the data.
+// Each msg from the provider is an event with ID sessionID.seq
+// so reconnecting with the Last-Event-ID header resumes the session.
+// Add ?poll=1 to long-poll: the response ends once there are events.
+// POST ?session=ID to send msgs to the provider, as newline-delimited JSON.
+// A session without any GET requests for sseSessionTimeout is closed.
+
+const (
+	sseSessionTimeout = 30 * time.Second
+	ssePollTimeout    = 25 * time.Second
+	sseKeepAlive      = 15 * time.Second
+	sseMaxEvents      = 1000 // per session, for resuming.
+	sseMaxPost        = 1 << 20
+)
+
+// ListenAndServeSSE listens and serves server-sent events and HTTP POST.
+func ListenAndServeSSE(opts Options, svc service.Servicer, tp service.MultiTransporter) error {
+	if opts.MaxConns == 0 {
+		opts.MaxConns = 1
+	}
+
+	u, err := url.Parse(opts.Addr)
+	if err != nil {
+		return err
+	}
+
+	switch u.Scheme {
+	case "http":
+		if opts.useTLS() {
+			return errors.New("expected https:// url")
+		}
+	case "https":
+		if !opts.useTLS() {
+			return errors.New("expected cert and private key for https://")
+		}
+	default:
+		return errors.New("not a valid http addr")
+	}
+	if err := opts.checkClientCA(); err != nil {
+		return err
+	}
+
+	mux := &http.ServeMux{}
+	httpserver := &http.Server{
+		Addr:    u.Host,
+		Handler: mux,
+	}
+	if opts.useTLS() {
+		httpserver.TLSConfig, err = opts.tlsConfig()
+		if err != nil {
+			return err
+		}
+	}
+	sseln := newSSEListener(u.Host)
+
+	pattern := u.Path
+	if pattern == "" {
+		pattern = "/"
+	}
+	mux.Handle(pattern, sseln)
+
+	srv := newProvider(opts, svc, tp)
+
+	httpch := make(chan struct{})
+	var httpErr error
+	go func() {
+		defer close(httpch)
+		if opts.useTLS() {
+			httpErr = httpserver.ListenAndServeTLS("", "") // From TLSConfig.
+		} else {
+			httpErr = httpserver.ListenAndServe()
+		}
+		srv.Close()
+		sseln.Close()
+	}()
+
+	srvErr := srv.Serve(sseln)
+
+	httpserver.Close()
+	<-httpch
+	if httpErr != nil && httpErr != http.ErrServerClosed {
+		return httpErr
+	}
+	return srvErr
+}
+
+var errSSEClosed = errors.New("sse listener closed")
+
+type sseAddr string
+
+func (addr sseAddr) Network() string { return "sse" }
+func (addr sseAddr) String() string  { return string(addr) }
+
+// sseListener is a net.Listener of sessions, and the http.Handler for them.
+type sseListener struct {
+	addr      sseAddr
+	connch    chan *sseConn
+	closed    chan struct{}
+	closeOnce sync.Once
+	mx        sync.Mutex
+	sessions  map[string]*sseConn // locked by mx
+}
+
+var _ net.Listener = &sseListener{}
+
+func newSSEListener(addr string) *sseListener {
+	return &sseListener{
+		addr:     sseAddr(addr),
+		connch:   make(chan *sseConn),
+		closed:   make(chan struct{}),
+		sessions: make(map[string]*sseConn),
+	}
+}
+
+func (ln *sseListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.connch:
+		return conn, nil
+	case <-ln.closed:
+		return nil, errSSEClosed
+	}
+}
+
+func (ln *sseListener) Close() error {
+	ln.closeOnce.Do(func() {
+		close(ln.closed)
+	})
+	ln.mx.Lock()
+	var conns []*sseConn
+	for _, conn := range ln.sessions {
+		conns = append(conns, conn)
+	}
+	ln.mx.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return nil
+}
+
+func (ln *sseListener) Addr() net.Addr {
+	return ln.addr
+}
+
+// getSession gets the session for the request,
+// which must be from the same client cert identity as the session, if any.
+func (ln *sseListener) getSession(id string, r *http.Request) *sseConn {
+	ln.mx.Lock()
+	conn := ln.sessions[id]
+	ln.mx.Unlock()
+	if conn != nil && stateCertIdentity(conn.tlsState) != stateCertIdentity(r.TLS) {
+		return nil
+	}
+	return conn
+}
+
+func (ln *sseListener) removeSession(id string) {
+	ln.mx.Lock()
+	defer ln.mx.Unlock()
+	delete(ln.sessions, id)
+}
+
+// newSession creates a session and waits for it to be accepted.
+func (ln *sseListener) newSession(r *http.Request) (*sseConn, error) {
+	var idbuf [16]byte
+	if _, err := rand.Read(idbuf[:]); err != nil {
+		return nil, err
+	}
+	conn := &sseConn{
+		ln:       ln,
+		id:       hex.EncodeToString(idbuf[:]),
+		remote:   sseAddr(r.RemoteAddr),
+		tlsState: r.TLS,
+		notify:   make(chan struct{}),
+	}
+	ln.mx.Lock()
+	ln.sessions[conn.id] = conn
+	ln.mx.Unlock()
+	select {
+	case ln.connch <- conn:
+		return conn, nil
+	case <-ln.closed:
+		conn.Close()
+		return nil, errSSEClosed
+	case <-r.Context().Done():
+		conn.Close()
+		return nil, r.Context().Err()
+	}
+}
+
+// parseEventID parses sessionID.seq
+func parseEventID(eventID string) (string, uint64, bool) {
+	idot := strings.LastIndexByte(eventID, '.')
+	if idot == -1 {
+		return "", 0, false
+	}
+	seq, err := strconv.ParseUint(eventID[idot+1:], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return eventID[:idot], seq, true
+}
+
+func (ln *sseListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		ln.serveEvents(w, r)
+	case "POST":
+		ln.servePost(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (ln *sseListener) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	poll := r.URL.Query().Get("poll") != ""
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	var conn *sseConn
+	var after uint64
+	if lastEventID != "" {
+		sessionID, seq, ok := parseEventID(lastEventID)
+		if ok {
+			conn = ln.getSession(sessionID, r)
+		}
+		if conn == nil {
+			// Cannot resume, the client needs to start over.
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		after = seq
+	} else {
+		var err error
+		conn, err = ln.newSession(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	conn.attach()
+	defer conn.detach()
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if lastEventID == "" {
+		io.WriteString(w, "event: session\nid: "+conn.id+".0\ndata: "+conn.id+"\n\n")
+		flusher.Flush()
+		if poll {
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	var pollTimeout <-chan time.Time
+	if poll {
+		timer := time.NewTimer(ssePollTimeout)
+		defer timer.Stop()
+		pollTimeout = timer.C
+	}
+	for {
+		events, gap, notify, closed := conn.eventsAfter(after)
+		if gap {
+			// Some events are no longer buffered.
+			io.WriteString(w, "event: gap\ndata: "+strconv.FormatUint(after, 10)+"\n\n")
+		}
+		for _, ev := range events {
+			writeSSEEvent(w, conn.id, ev)
+			after = ev.seq
+		}
+		if len(events) > 0 || gap {
+			flusher.Flush()
+			if poll {
+				return
+			}
+		}
+		if closed {
+			return
+		}
+		select {
+		case <-notify:
+		case <-keepAlive.C:
+			io.WriteString(w, ":\n\n")
+			flusher.Flush()
+		case <-pollTimeout:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeSSEEvent(w io.Writer, sessionID string, ev sseEvent) {
+	sb := &strings.Builder{}
+	sb.WriteString("id: ")
+	sb.WriteString(sessionID)
+	sb.WriteByte('.')
+	sb.WriteString(strconv.FormatUint(ev.seq, 10))
+	sb.WriteByte('\n')
+	for _, line := range strings.Split(string(ev.data), "\n") {
+		sb.WriteString("data: ")
+		sb.WriteString(line)
+		sb.WriteByte('\n')
+	}
+	sb.WriteByte('\n')
+	io.WriteString(w, sb.String())
+}
+
+func (ln *sseListener) servePost(w http.ResponseWriter, r *http.Request) {
+	conn := ln.getSession(r.URL.Query().Get("session"), r)
+	if conn == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, sseMaxPost))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := conn.addIncoming(data); err != nil {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+type sseEvent struct {
+	seq  uint64
+	data []byte
+}
+
+// sseConn is a session, as a conn for the provider.
+type sseConn struct {
+	ln       *sseListener
+	id       string
+	remote   sseAddr
+	tlsState *tls.ConnectionState // of the request creating the session, or nil.
+	mx       sync.Mutex
+	in       bytes.Buffer  // incoming, locked by mx
+	events   []sseEvent    // outgoing, locked by mx
+	seq      uint64        // last event seq, locked by mx
+	notify   chan struct{} // closed and replaced upon changes, locked by mx
+	attached int           // number of GET requests, locked by mx
+	expire   *time.Timer   // locked by mx
+	closed   bool          // locked by mx
+}
+
+var _ net.Conn = &sseConn{}
+var _ tlsStater = &sseConn{}
+
+func (conn *sseConn) ConnectionState() tls.ConnectionState {
+	if conn.tlsState == nil {
+		return tls.ConnectionState{}
+	}
+	return *conn.tlsState
+}
+
+// changed notifies waiters, call with mx locked.
+func (conn *sseConn) changed() {
+	close(conn.notify)
+	conn.notify = make(chan struct{})
+}
+
+func (conn *sseConn) attach() {
+	conn.mx.Lock()
+	defer conn.mx.Unlock()
+	conn.attached++
+	if conn.expire != nil {
+		conn.expire.Stop()
+		conn.expire = nil
+	}
+}
+
+func (conn *sseConn) detach() {
+	conn.mx.Lock()
+	defer conn.mx.Unlock()
+	conn.attached--
+	if conn.attached == 0 && !conn.closed {
+		conn.expire = time.AfterFunc(sseSessionTimeout, func() {
+			conn.mx.Lock()
+			expired := conn.attached == 0
+			conn.mx.Unlock()
+			if expired {
+				conn.Close()
+			}
+		})
+	}
+}
+
+// eventsAfter returns the events after seq, gap is true if some are missing.
+// Wait on notify for more events.
+func (conn *sseConn) eventsAfter(seq uint64) (events []sseEvent, gap bool,
+	notify <-chan struct{}, closed bool) {
+	conn.mx.Lock()
+	defer conn.mx.Unlock()
+	if len(conn.events) > 0 && conn.events[0].seq > seq+1 {
+		gap = true
+	}
+	for i, ev := range conn.events {
+		if ev.seq > seq {
+			events = append(events, conn.events[i:]...)
+			break
+		}
+	}
+	return events, gap, conn.notify, conn.closed
+}
+
+func (conn *sseConn) addIncoming(data []byte) error {
+	conn.mx.Lock()
+	defer conn.mx.Unlock()
+	if conn.closed {
+		return io.ErrClosedPipe
+	}
+	conn.in.Write(data)
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		conn.in.WriteByte('\n')
+	}
+	conn.changed()
+	return nil
+}
+
+func (conn *sseConn) Read(b []byte) (int, error) {
+	for {
+		conn.mx.Lock()
+		if conn.in.Len() > 0 {
+			n, err := conn.in.Read(b)
+			conn.mx.Unlock()
+			return n, err
+		}
+		closed, notify := conn.closed, conn.notify
+		conn.mx.Unlock()
+		if closed {
+			return 0, io.EOF
+		}
+		<-notify
+	}
+}
+
+// Write adds an event, CBOR is transcoded to JSON since events are text.
+func (conn *sseConn) Write(b []byte) (int, error) {
+	var data []byte
+	if stdchat.IsCBOR(b) {
+		var err error
+		data, err = stdchat.CBORToJSON(b)
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		// Only the newline delimiter of the JSON.
+		data = append([]byte(nil), bytes.TrimSuffix(b, []byte("\n"))...)
+	}
+	conn.mx.Lock()
+	defer conn.mx.Unlock()
+	if conn.closed {
+		return 0, io.ErrClosedPipe
+	}
+	conn.seq++
+	conn.events = append(conn.events, sseEvent{conn.seq, data})
+	if len(conn.events) > sseMaxEvents {
+		conn.events = append(conn.events[:0], conn.events[len(conn.events)-sseMaxEvents:]...)
+	}
+	conn.changed()
+	return len(b), nil
+}
+
+func (conn *sseConn) Close() error {
+	conn.mx.Lock()
+	if conn.closed {
+		conn.mx.Unlock()
+		return nil
+	}
+	conn.closed = true
+	if conn.expire != nil {
+		conn.expire.Stop()
+		conn.expire = nil
+	}
+	conn.changed()
+	conn.mx.Unlock()
+	conn.ln.removeSession(conn.id)
+	return nil
+}
+
+func (conn *sseConn) LocalAddr() net.Addr {
+	return conn.ln.addr
+}
+
+func (conn *sseConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+// Deadlines are not supported.
+func (conn *sseConn) SetDeadline(t time.Time) error      { return nil }
+func (conn *sseConn) SetReadDeadline(t time.Time) error  { return nil }
+func (conn *sseConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,55 @@
+package provider_test
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/millerlogic/server-go"
+	"stdchat.org"
+	"stdchat.org/provider"
+	"stdchat.org/service"
+	"stdchat.org/service/dummy"
+)
+
+// stdioBuffer reads the input, and buffers the output.
+type stdioBuffer struct {
+	in  *strings.Reader
+	out bytes.Buffer
+}
+
+func (b *stdioBuffer) Read(p []byte) (int, error)  { return b.in.Read(p) }
+func (b *stdioBuffer) Write(p []byte) (int, error) { return b.out.Write(p) }
+func (b *stdioBuffer) Close() error                { return nil }
+
+func TestServeIOResponses(t *testing.T) {
+	const n = 3
+	input := ""
+	for i := 1; i <= n; i++ {
+		input += `{"type":"cmd","id":"r` + strconv.Itoa(i) + `","cmd":"ping","args":["x"]}` + "\n"
+	}
+	stdio := &stdioBuffer{in: strings.NewReader(input)}
+	tp := &service.MultiTransport{Protocol: dummy.Protocol}
+	svc := dummy.NewService(tp)
+	err := provider.ServeIO(stdio, provider.DefaultOptions, svc, tp)
+	if err != nil && err != server.ErrServerClosed {
+		t.Fatal(err)
+	}
+	pongs := 0
+	output := stdio.out.String()
+	scan := bufio.NewScanner(strings.NewReader(output))
+	for scan.Scan() {
+		env, err := stdchat.DecodeEnvelope(scan.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Topic.Node == "other" && strings.Contains(scan.Text(), `"other/ping"`) {
+			pongs++
+		}
+	}
+	if pongs != n {
+		t.Fatalf("got %d ping responses, expected %d:\n%s", pongs, n, output)
+	}
+}
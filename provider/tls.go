@@ -0,0 +1,93 @@
+package provider
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+const tlsHandshakeTimeout = 10 * time.Second
+
+// tlsConfig gets the server TLS config from the cert and private key,
+// requiring and verifying client certs if ClientCAPath is set.
+func (opts *Options) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(opts.CertPath, opts.PrivateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if opts.ClientCAPath != "" {
+		pem, err := ioutil.ReadFile(opts.ClientCAPath)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + opts.ClientCAPath)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// checkClientCA returns an error if ClientCAPath is set without TLS.
+func (opts *Options) checkClientCA() error {
+	if (opts.ClientCAPath != "" || opts.ClientCertAuth) && !opts.useTLS() {
+		return errors.New("client certificates require cert and privkey")
+	}
+	if opts.ClientCertAuth && opts.ClientCAPath == "" {
+		return errors.New("client certificate auth requires a client CA")
+	}
+	return nil
+}
+
+// tlsStater is a conn with TLS, such as *tls.Conn
+type tlsStater interface {
+	ConnectionState() tls.ConnectionState
+}
+
+// connCertIdentity gets the identity from the verified client cert,
+// completing the TLS handshake if needed. Returns empty if none.
+func connCertIdentity(conn net.Conn) string {
+	if tconn, ok := conn.(*tls.Conn); ok {
+		tconn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		err := tconn.Handshake()
+		tconn.SetDeadline(time.Time{})
+		if err != nil {
+			return ""
+		}
+	}
+	ts, ok := conn.(tlsStater)
+	if !ok {
+		return ""
+	}
+	state := ts.ConnectionState()
+	return stateCertIdentity(&state)
+}
+
+// stateCertIdentity gets the identity from the verified client cert.
+func stateCertIdentity(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return certIdentity(state.VerifiedChains[0][0])
+}
+
+// certIdentity is the subject common name of the cert,
+// or the first email address or DNS name if no common name.
+func certIdentity(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return ""
+}
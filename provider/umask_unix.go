@@ -0,0 +1,20 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package provider
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenUnixMode listens on a unix socket created with the permissions,
+// by setting the umask while creating it, so there is no window where
+// the socket can be connected to with other permissions.
+// The umask is process wide, files created meanwhile get it too.
+func listenUnixMode(path string, mode os.FileMode) (net.Listener, error) {
+	old := syscall.Umask(int(^mode & os.ModePerm))
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
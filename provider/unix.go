@@ -0,0 +1,138 @@
+package provider
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"stdchat.org/service"
+)
+
+// ListenAndServeUnix listens and serves on a unix domain socket,
+// opts.Addr is unix:/path/to/socket
+// The socket file is created with opts.SocketMode if set,
+// and an existing socket file at the path is replaced.
+func ListenAndServeUnix(opts Options, svc service.Servicer, tp service.MultiTransporter) error {
+	if opts.useTLS() {
+		return errors.New("Do not use cert/privkey with unix sockets")
+	}
+	if err := opts.checkClientCA(); err != nil {
+		return err
+	}
+	ln, err := listenUnix(strings.TrimPrefix(opts.Addr, "unix:"), opts.SocketMode)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	return Serve(ln, opts, svc, tp)
+}
+
+func listenUnix(path, socketMode string) (net.Listener, error) {
+	if path == "" {
+		return nil, errors.New("expected unix:/path/to/socket")
+	}
+	var mode os.FileMode
+	if socketMode != "" {
+		x, err := strconv.ParseUint(socketMode, 8, 32)
+		if err != nil {
+			return nil, errors.New("invalid socket mode: " + socketMode)
+		}
+		mode = os.FileMode(x)
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path) // Stale socket.
+	}
+	if mode != 0 {
+		return listenUnixMode(path, mode)
+	}
+	return net.Listen("unix", path)
+}
+
+// ListenAndServeSystemd serves on a listener inherited from systemd
+// socket activation (LISTEN_FDS), opts.Addr is systemd: or systemd:name
+// where name is from FileDescriptorName= in the socket unit.
+// TLS is used if the cert and private key are set.
+func ListenAndServeSystemd(opts Options, svc service.Servicer, tp service.MultiTransporter) error {
+	if err := opts.checkClientCA(); err != nil {
+		return err
+	}
+	ln, err := systemdListener(strings.TrimPrefix(opts.Addr, "systemd:"))
+	if err != nil {
+		return err
+	}
+	if opts.useTLS() {
+		config, err := opts.tlsConfig()
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		ln = tls.NewListener(ln, config)
+	}
+	defer ln.Close()
+	return Serve(ln, opts, svc, tp)
+}
+
+const listenFDsStart = 3 // SD_LISTEN_FDS_START
+
+// systemdListener gets the inherited listener with the name,
+// or the first listener if name is empty.
+func systemdListener(name string) (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("no listeners from systemd (LISTEN_PID)")
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds < 1 {
+		return nil, errors.New("no listeners from systemd (LISTEN_FDS)")
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// Not passed on to child processes.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	for i := 0; i < nfds; i++ {
+		fdname := ""
+		if i < len(names) {
+			fdname = names[i]
+		}
+		if name != "" && fdname != name {
+			continue
+		}
+		fd := listenFDsStart + i
+		f := os.NewFile(uintptr(fd), fdname)
+		ln, err := net.FileListener(f)
+		f.Close() // FileListener dups the fd.
+		return ln, err
+	}
+	return nil, errors.New("no listener from systemd named " + name)
+}
+
+// peerAllowed returns true if the conn is a unix socket from a peer
+// allowed by opts.PeerAuth, which can skip provider-auth.
+func peerAllowed(opts *Options, conn net.Conn) bool {
+	if opts.PeerAuth == "" {
+		return false
+	}
+	uconn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return false
+	}
+	uid, err := getPeerUID(uconn)
+	if err != nil {
+		return false
+	}
+	for _, x := range strings.Split(opts.PeerAuth, ",") {
+		x = strings.TrimSpace(x)
+		if x == "self" {
+			if uid == os.Getuid() {
+				return true
+			}
+		} else if n, err := strconv.Atoi(x); err == nil && n == uid {
+			return true
+		}
+	}
+	return false
+}
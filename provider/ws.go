@@ -0,0 +1,120 @@
+package provider
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"nhooyr.io/websocket"
+	"stdchat.org/internal/wsconn"
+)
+
+// wsConn is an accepted websocket, with the remote address and TLS state
+// of the HTTP request.
+type wsConn struct {
+	*wsconn.Conn
+	remote   wsAddr
+	tlsState *tls.ConnectionState // of the upgraded request, or nil.
+}
+
+func (conn *wsConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+var _ pinger = &wsConn{}
+var _ tlsStater = &wsConn{}
+
+func (conn *wsConn) ConnectionState() tls.ConnectionState {
+	if conn.tlsState == nil {
+		return tls.ConnectionState{}
+	}
+	return *conn.tlsState
+}
+
+const wsAcceptTimeout = 3 * time.Second
+
+type wsAddr string
+
+func (addr wsAddr) Network() string { return "websocket" }
+func (addr wsAddr) String() string  { return string(addr) }
+
+// wsListener is a net.Listener of websockets, and the http.Handler to serve them.
+// Accepted conns are a wsConn, which sends CBOR in binary messages.
+type wsListener struct {
+	accepting chan func() (net.Conn, error)
+	done      chan struct{} // closed by Close.
+	closeOnce sync.Once
+}
+
+func newWSListener() *wsListener {
+	return &wsListener{
+		accepting: make(chan func() (net.Conn, error)),
+		done:      make(chan struct{}),
+	}
+}
+
+func (ln *wsListener) Accept() (net.Conn, error) {
+	for {
+		select {
+		case acc := <-ln.accepting:
+			conn, err := acc()
+			if err == nil {
+				return conn, nil
+			}
+		case <-ln.done:
+			return nil, os.ErrClosed
+		}
+	}
+}
+
+func (ln *wsListener) Close() error {
+	ln.closeOnce.Do(func() {
+		close(ln.done)
+	})
+	return nil
+}
+
+func (ln *wsListener) Addr() net.Addr {
+	return wsAddr("websocket")
+}
+
+// ServeHTTP upgrades the request to a websocket once Accept is called,
+// or responds with an error if not accepted in time.
+func (ln *wsListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	finishing := make(chan struct{})
+	ok := int32(1)
+	acc := func() (net.Conn, error) {
+		if !atomic.CompareAndSwapInt32(&ok, 1, 0) {
+			return nil, errors.New("timed out")
+		}
+		defer close(finishing)
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return nil, err // Accept responded with the error.
+		}
+		return &wsConn{Conn: wsconn.New(ws), remote: wsAddr(r.RemoteAddr), tlsState: r.TLS}, nil
+	}
+	timeout := time.NewTimer(wsAcceptTimeout)
+	defer timeout.Stop()
+	select {
+	case ln.accepting <- acc:
+		select {
+		case <-finishing:
+		case <-timeout.C:
+			if atomic.CompareAndSwapInt32(&ok, 1, 0) {
+				http.Error(w, "timed out", http.StatusGatewayTimeout)
+			} else {
+				<-finishing // Accepting, w is in use.
+			}
+		}
+	case <-timeout.C:
+		http.Error(w, "timed out", http.StatusGatewayTimeout)
+	case <-ln.done:
+		http.Error(w, "closed", http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,269 @@
+package richtext
+
+import (
+	"html"
+	"strings"
+)
+
+var htmlStyleTags = map[string]style{
+	"b":      bold,
+	"strong": bold,
+	"i":      italic,
+	"em":     italic,
+	"u":      underline,
+	"ins":    underline,
+	"s":      strike,
+	"strike": strike,
+	"del":    strike,
+	"code":   code,
+	"tt":     code,
+	"pre":    code,
+}
+
+var htmlBlockTags = map[string]bool{
+	"p": true, "div": true, "li": true, "tr": true, "blockquote": true,
+	"ul": true, "ol": true, "table": true, "pre": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+}
+
+func htmlTagName(tag string) string {
+	tag = strings.TrimPrefix(tag, "/")
+	iend := strings.IndexAny(tag, " \t\r\n/")
+	if iend != -1 {
+		tag = tag[:iend]
+	}
+	return strings.ToLower(tag)
+}
+
+// htmlAttr gets the value of the named attribute in the tag, or empty string.
+func htmlAttr(tag, name string) string {
+	ltag := strings.ToLower(tag)
+	for i := 0; ; {
+		j := strings.Index(ltag[i:], name)
+		if j == -1 {
+			return ""
+		}
+		i += j + len(name)
+		rest := strings.TrimLeft(tag[i:], " \t\r\n")
+		if i == len(name) || !strings.ContainsAny(ltag[i-len(name)-1:i-len(name)], " \t\r\n") ||
+			!strings.HasPrefix(rest, "=") {
+			continue // Only part of another name.
+		}
+		rest = strings.TrimLeft(rest[1:], " \t\r\n")
+		if rest != "" && (rest[0] == '"' || rest[0] == '\'') {
+			if iend := strings.IndexByte(rest[1:], rest[0]); iend != -1 {
+				return html.UnescapeString(rest[1 : 1+iend])
+			}
+			return html.UnescapeString(rest[1:])
+		}
+		if iend := strings.IndexAny(rest, " \t\r\n"); iend != -1 {
+			rest = rest[:iend]
+		}
+		return html.UnescapeString(strings.TrimSuffix(rest, "/"))
+	}
+}
+
+// collapseSpace collapses runs of HTML whitespace into single spaces.
+func collapseSpace(s string) string {
+	sb := &strings.Builder{}
+	space := false
+	for _, r := range s {
+		switch r {
+		case ' ', '\t', '\r', '\n', '\f':
+			space = true
+		default:
+			if space {
+				sb.WriteByte(' ')
+				space = false
+			}
+			sb.WriteRune(r)
+		}
+	}
+	if space {
+		sb.WriteByte(' ')
+	}
+	return sb.String()
+}
+
+func parseHTML(content string) []span {
+	b := &spanBuilder{}
+	var counts [8]int // per style bit.
+	var links, colors []string
+	pre := 0
+	newline := true // at the start of a line.
+	writeText := func(s string) {
+		if pre == 0 {
+			s = collapseSpace(s)
+			if newline {
+				s = strings.TrimLeft(s, " ")
+			}
+		}
+		s = html.UnescapeString(s)
+		if s != "" {
+			b.writeString(s)
+			newline = s[len(s)-1] == '\n'
+		}
+	}
+	writeNewline := func() {
+		b.writeByte('\n')
+		newline = true
+	}
+	for text := content; text != ""; {
+		i := strings.IndexByte(text, '<')
+		if i == -1 {
+			writeText(text)
+			break
+		}
+		writeText(text[:i])
+		text = text[i:]
+		j := strings.IndexByte(text, '>')
+		if j == -1 {
+			writeText(text)
+			break
+		}
+		tag := text[1:j]
+		text = text[j+1:]
+		if strings.HasPrefix(tag, "!") || strings.HasPrefix(tag, "?") {
+			continue // Comment, doctype, etc.
+		}
+		closing := strings.HasPrefix(tag, "/")
+		name := htmlTagName(tag)
+		if s, ok := htmlStyleTags[name]; ok {
+			ibit := 0
+			for s>>uint(ibit) != 1 {
+				ibit++
+			}
+			if closing {
+				if counts[ibit] > 0 {
+					counts[ibit]--
+				}
+			} else {
+				counts[ibit]++
+			}
+		}
+		switch name {
+		case "a":
+			if closing {
+				if len(links) > 0 {
+					links = links[:len(links)-1]
+				}
+			} else {
+				links = append(links, htmlAttr(tag, "href"))
+			}
+		case "font":
+			if closing {
+				if len(colors) > 0 {
+					colors = colors[:len(colors)-1]
+				}
+			} else {
+				colors = append(colors, normalizeColor(htmlAttr(tag, "color")))
+			}
+		case "br":
+			writeNewline()
+		case "pre":
+			if closing {
+				if pre > 0 {
+					pre--
+				}
+			} else {
+				pre++
+			}
+		case "script", "style", "head", "title":
+			if !closing {
+				iend := strings.Index(strings.ToLower(text), "</"+name)
+				if iend == -1 {
+					text = ""
+				} else {
+					text = text[iend:]
+				}
+			}
+		}
+		if htmlBlockTags[name] && !newline {
+			writeNewline()
+		}
+		x := span{}
+		for ibit, n := range counts {
+			if n > 0 {
+				x.style |= 1 << uint(ibit)
+			}
+		}
+		if len(links) > 0 {
+			x.link = links[len(links)-1]
+		}
+		if len(colors) > 0 {
+			x.color = colors[len(colors)-1]
+		}
+		b.setFormat(x)
+	}
+	return trimSpans(b.getSpans())
+}
+
+// trimSpans removes trailing whitespace from the spans.
+func trimSpans(spans []span) []span {
+	for len(spans) > 0 {
+		last := &spans[len(spans)-1]
+		last.text = strings.TrimRight(last.text, " \n")
+		if last.text != "" {
+			break
+		}
+		spans = spans[:len(spans)-1]
+	}
+	return spans
+}
+
+var htmlStyleOrder = []struct {
+	style style
+	tag   string
+}{
+	{bold, "b"},
+	{italic, "i"},
+	{underline, "u"},
+	{strike, "s"},
+	{code, "code"},
+}
+
+// safeLinkSchemes are the URL schemes rendered as HTML links,
+// others such as javascript: are only rendered as text.
+var safeLinkSchemes = []string{"http", "https", "mailto", "irc", "ircs"}
+
+// safeLink returns true if the link has one of the safeLinkSchemes.
+func safeLink(link string) bool {
+	i := strings.IndexByte(link, ':')
+	if i == -1 {
+		return false
+	}
+	scheme := strings.ToLower(link[:i])
+	for _, x := range safeLinkSchemes {
+		if scheme == x {
+			return true
+		}
+	}
+	return false
+}
+
+func renderHTML(spans []span) string {
+	sb := &strings.Builder{}
+	for _, x := range spans {
+		var closeTags []string
+		if x.link != "" && safeLink(x.link) {
+			sb.WriteString(`<a href="` + html.EscapeString(x.link) + `">`)
+			closeTags = append(closeTags, "</a>")
+		}
+		if x.color != "" {
+			sb.WriteString(`<font color="` + html.EscapeString(x.color) + `">`)
+			closeTags = append(closeTags, "</font>")
+		}
+		for _, st := range htmlStyleOrder {
+			if x.style&st.style != 0 {
+				sb.WriteString("<" + st.tag + ">")
+				closeTags = append(closeTags, "</"+st.tag+">")
+			}
+		}
+		text := html.EscapeString(x.text)
+		sb.WriteString(strings.Replace(text, "\n", "<br>", -1))
+		for i := len(closeTags) - 1; i >= 0; i-- {
+			sb.WriteString(closeTags[i])
+		}
+	}
+	return sb.String()
+}
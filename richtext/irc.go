@@ -0,0 +1,200 @@
+package richtext
+
+import (
+	"strconv"
+	"strings"
+)
+
+// IRC formatting codes.
+const (
+	ircBold          = '\x02'
+	ircColor         = '\x03'
+	ircHexColor      = '\x04'
+	ircReset         = '\x0f'
+	ircMonospace     = '\x11'
+	ircReverse       = '\x16'
+	ircItalic        = '\x1d'
+	ircStrikethrough = '\x1e'
+	ircUnderline     = '\x1f'
+
+	// ircSeparate is written between a color code and text which would
+	// otherwise be read as part of the code, the two bold toggles cancel out.
+	ircSeparate = "\x02\x02"
+)
+
+// ircColors is the standard 16 color palette, as #RRGGBB
+var ircColors = [16]string{
+	"#FFFFFF", "#000000", "#00007F", "#009300",
+	"#FF0000", "#7F0000", "#9C009C", "#FC7F00",
+	"#FFFF00", "#00FC00", "#009393", "#00FFFF",
+	"#0000FC", "#FF00FF", "#7F7F7F", "#D2D2D2",
+}
+
+var namedColors = map[string]string{
+	"white": "#FFFFFF", "black": "#000000", "navy": "#000080", "green": "#008000",
+	"red": "#FF0000", "maroon": "#800000", "purple": "#800080", "orange": "#FFA500",
+	"yellow": "#FFFF00", "lime": "#00FF00", "teal": "#008080", "cyan": "#00FFFF",
+	"aqua": "#00FFFF", "blue": "#0000FF", "fuchsia": "#FF00FF", "magenta": "#FF00FF",
+	"gray": "#808080", "grey": "#808080", "silver": "#C0C0C0",
+}
+
+func isHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeColor converts an HTML color to #RRGGBB, or empty string if unknown.
+func normalizeColor(color string) string {
+	color = strings.TrimSpace(color)
+	if c, ok := namedColors[strings.ToLower(color)]; ok {
+		return c
+	}
+	if strings.HasPrefix(color, "#") && isHex(color[1:]) {
+		switch len(color) {
+		case 7:
+			return strings.ToUpper(color)
+		case 4:
+			r, g, b := color[1:2], color[2:3], color[3:4]
+			return strings.ToUpper("#" + r + r + g + g + b + b)
+		}
+	}
+	return ""
+}
+
+// ircColorCode returns the palette index for the color, or -1.
+func ircColorCode(color string) int {
+	for i, c := range ircColors {
+		if c == color {
+			return i
+		}
+	}
+	return -1
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// parseIRCColorNum parses up to 2 digits at the start of s.
+func parseIRCColorNum(s string) (int, int) {
+	n := 0
+	for n < 2 && n < len(s) && isDigit(s[n]) {
+		n++
+	}
+	if n == 0 {
+		return -1, 0
+	}
+	num, _ := strconv.Atoi(s[:n])
+	return num, n
+}
+
+func parseIRC(content string) []span {
+	b := &spanBuilder{}
+	s := content
+	for i := 0; i < len(s); {
+		c := s[i]
+		i++
+		switch c {
+		case ircBold:
+			b.toggle(bold)
+		case ircItalic:
+			b.toggle(italic)
+		case ircUnderline:
+			b.toggle(underline)
+		case ircStrikethrough:
+			b.toggle(strike)
+		case ircMonospace:
+			b.toggle(code)
+		case ircReverse:
+			// Not supported.
+		case ircReset:
+			b.setFormat(span{})
+		case ircColor:
+			x := b.cur
+			x.color = ""
+			fg, n := parseIRCColorNum(s[i:])
+			if n > 0 {
+				i += n
+				if fg < len(ircColors) {
+					x.color = ircColors[fg]
+				}
+				if i+1 < len(s) && s[i] == ',' {
+					if _, n := parseIRCColorNum(s[i+1:]); n > 0 {
+						i += 1 + n // Background is not supported.
+					}
+				}
+			}
+			b.setFormat(x)
+		case ircHexColor:
+			x := b.cur
+			x.color = ""
+			if i+6 <= len(s) && isHex(s[i:i+6]) {
+				x.color = strings.ToUpper("#" + s[i:i+6])
+				i += 6
+				if i+7 <= len(s) && s[i] == ',' && isHex(s[i+1:i+7]) {
+					i += 7
+				}
+			}
+			b.setFormat(x)
+		default:
+			b.writeByte(c)
+		}
+	}
+	return b.getSpans()
+}
+
+var ircStyleCodes = []struct {
+	style style
+	code  byte
+}{
+	{bold, ircBold},
+	{italic, ircItalic},
+	{underline, ircUnderline},
+	{strike, ircStrikethrough},
+	{code, ircMonospace},
+}
+
+func renderIRC(spans []span) string {
+	sb := &strings.Builder{}
+	cur := span{}
+	for _, x := range spans {
+		for _, st := range ircStyleCodes {
+			if (cur.style^x.style)&st.style != 0 {
+				sb.WriteByte(st.code)
+			}
+		}
+		text := linkText(x)
+		if x.color != cur.color {
+			if x.color == "" {
+				sb.WriteByte(ircColor)
+				if text != "" && isDigit(text[0]) {
+					sb.WriteString(ircSeparate) // Not a color number.
+				}
+			} else if code := ircColorCode(x.color); code != -1 {
+				num := strconv.Itoa(code)
+				if len(num) == 1 {
+					num = "0" + num // So a following digit is not part of it.
+				}
+				sb.WriteByte(ircColor)
+				sb.WriteString(num)
+				if len(text) > 1 && text[0] == ',' && isDigit(text[1]) {
+					sb.WriteString(ircSeparate) // Not a background color.
+				}
+			} else {
+				sb.WriteByte(ircHexColor)
+				sb.WriteString(x.color[1:])
+				if text != "" && text[0] == ',' {
+					sb.WriteString(ircSeparate) // Not a background color.
+				}
+			}
+		}
+		cur = x
+		sb.WriteString(text)
+	}
+	return sb.String()
+}
@@ -0,0 +1,231 @@
+package richtext
+
+import (
+	"strings"
+)
+
+// Inline markdown only: emphasis, strikethrough, code spans and links.
+// Newlines are line breaks, as is common for chat.
+
+const markdownEscapable = "\\`*_~[]()<>#" // can be escaped.
+const markdownEscape = "\\`*_~[]<"        // needs escaping in text.
+
+var markdownMarkers = []struct {
+	marker string
+	style  style
+}{
+	// Longest first.
+	{"**", bold},
+	{"__", bold},
+	{"~~", strike},
+	{"*", italic},
+	{"_", italic},
+}
+
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
+
+// parseMarkdownLink parses [text](url) at the start of s,
+// returns the length parsed or 0 if not a link.
+func parseMarkdownLink(s string) (text, url string, n int) {
+	iclose := strings.Index(s, "](")
+	if iclose == -1 || strings.IndexByte(s[1:iclose], '\n') != -1 {
+		return "", "", 0
+	}
+	iend := strings.IndexByte(s[iclose+2:], ')')
+	if iend == -1 {
+		return "", "", 0
+	}
+	url = s[iclose+2 : iclose+2+iend]
+	if url == "" || strings.ContainsAny(url, " \n") {
+		return "", "", 0
+	}
+	return s[1:iclose], url, iclose + 2 + iend + 1
+}
+
+func parseMarkdown(content string) []span {
+	b := &spanBuilder{}
+	s := content
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte(markdownEscapable, s[i+1]) != -1:
+			b.writeByte(s[i+1])
+			i += 2
+			continue
+		case c == '`':
+			fence := "`"
+			if strings.HasPrefix(s[i:], "``") {
+				fence = "``"
+			}
+			iend := strings.Index(s[i+len(fence):], fence)
+			if iend != -1 {
+				text := s[i+len(fence) : i+len(fence)+iend]
+				if fence == "``" {
+					text = strings.TrimPrefix(strings.TrimSuffix(text, " "), " ")
+				}
+				b.toggle(code)
+				b.writeString(text)
+				b.toggle(code)
+				i += len(fence) + iend + len(fence)
+				continue
+			}
+		case c == '[':
+			text, url, n := parseMarkdownLink(s[i:])
+			if n > 0 {
+				outer := b.cur
+				for _, xs := range parseMarkdown(text) {
+					xs.style |= outer.style
+					xs.link = url
+					if xs.color == "" {
+						xs.color = outer.color
+					}
+					b.setFormat(xs)
+					b.writeString(xs.text)
+				}
+				b.setFormat(outer)
+				i += n
+				continue
+			}
+		case c == '<':
+			// Autolink: <http://example.com>
+			iend := strings.IndexByte(s[i:], '>')
+			if iend != -1 {
+				url := s[i+1 : i+iend]
+				if strings.Contains(url, "://") && !strings.ContainsAny(url, " \n") {
+					x := b.cur
+					x.link = url
+					b.setFormat(x)
+					b.writeString(url)
+					x.link = ""
+					b.setFormat(x)
+					i += iend + 1
+					continue
+				}
+			}
+		case c == '*' || c == '_' || c == '~':
+			if n := markdownMarker(b, s, i); n > 0 {
+				i += n
+				continue
+			}
+		}
+		b.writeByte(c)
+		i++
+	}
+	return b.getSpans()
+}
+
+// markdownMarker handles an emphasis marker at s[i],
+// returns the length of the marker, or 0 if not a marker.
+func markdownMarker(b *spanBuilder, s string, i int) int {
+	for _, m := range markdownMarkers {
+		if !strings.HasPrefix(s[i:], m.marker) {
+			continue
+		}
+		after := i + len(m.marker)
+		if b.cur.style&m.style != 0 {
+			// Closing, not after a space.
+			if i > 0 && s[i-1] != ' ' && s[i-1] != '\n' &&
+				(m.marker[0] != '_' || after >= len(s) || !isWordByte(s[after])) {
+				b.toggle(m.style)
+				return len(m.marker)
+			}
+			return 0
+		}
+		// Opening, not before a space, and only if closed later.
+		if after >= len(s) || s[after] == ' ' || s[after] == '\n' {
+			return 0
+		}
+		if m.marker[0] == '_' && i > 0 && isWordByte(s[i-1]) {
+			return 0 // intra_word underscores.
+		}
+		if !strings.Contains(s[after+1:], m.marker) {
+			return 0
+		}
+		b.toggle(m.style)
+		return len(m.marker)
+	}
+	return 0
+}
+
+func escapeMarkdown(s string) string {
+	sb := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(markdownEscape, s[i]) != -1 {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// escapeMarkdownLink percent-encodes the chars which end a link or autolink.
+func escapeMarkdownLink(link string) string {
+	sb := &strings.Builder{}
+	for i := 0; i < len(link); i++ {
+		switch c := link[i]; c {
+		case '(', ')', '<', '>', ' ', '\n':
+			const hex = "0123456789ABCDEF"
+			sb.WriteByte('%')
+			sb.WriteByte(hex[c>>4])
+			sb.WriteByte(hex[c&0xF])
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+var markdownStyleOrder = []struct {
+	style  style
+	marker string
+}{
+	{bold, "**"},
+	{italic, "*"},
+	{strike, "~~"},
+}
+
+func renderMarkdown(spans []span) string {
+	sb := &strings.Builder{}
+	for _, x := range spans {
+		link := ""
+		if x.link != "" && safeLink(x.link) {
+			link = escapeMarkdownLink(x.link)
+		}
+		if link != "" && x.link == x.text && strings.Contains(link, "://") {
+			sb.WriteString("<" + link + ">")
+			continue
+		}
+		text := x.text
+		// Keep surrounding whitespace outside the markers.
+		trimmed := strings.TrimLeft(text, " \n")
+		lead := text[:len(text)-len(trimmed)]
+		text = strings.TrimRight(trimmed, " \n")
+		trail := trimmed[len(text):]
+		if text == "" {
+			sb.WriteString(lead + trail)
+			continue
+		}
+		if x.style&code != 0 {
+			if strings.IndexByte(text, '`') != -1 {
+				text = "`` " + text + " ``"
+			} else {
+				text = "`" + text + "`"
+			}
+		} else {
+			text = escapeMarkdown(text)
+		}
+		for i := len(markdownStyleOrder) - 1; i >= 0; i-- {
+			st := markdownStyleOrder[i]
+			if x.style&st.style != 0 {
+				text = st.marker + text + st.marker
+			}
+		}
+		if link != "" {
+			text = "[" + text + "](" + link + ")"
+		}
+		sb.WriteString(lead + text + trail)
+	}
+	return sb.String()
+}
@@ -0,0 +1,152 @@
+// Package richtext converts messages between MIME types,
+// such as text/plain, text/html, text/markdown and IRC formatting codes.
+// Converters are registered by source and target type,
+// and conversions can chain through several converters.
+package richtext
+
+import (
+	"errors"
+	"sync"
+
+	"stdchat.org"
+)
+
+// Built-in MIME types.
+const (
+	Plain    = "text/plain"
+	HTML     = "text/html"
+	Markdown = "text/markdown"
+	IRC      = "text/x-irc" // IRC formatting codes, such as 0x02 for bold.
+)
+
+var ErrNoConverter = errors.New("no converter for message type")
+
+// ConvertFunc converts content from one MIME type to another.
+type ConvertFunc = func(content string) (string, error)
+
+var converters = struct {
+	mx sync.RWMutex
+	m  map[string]map[string]ConvertFunc // from -> to -> fn, locked by mx
+}{m: make(map[string]map[string]ConvertFunc)}
+
+// Register a converter from one MIME type to another.
+// Replaces any existing converter for the same types.
+func Register(from, to string, fn ConvertFunc) {
+	if fn == nil {
+		panic("nil ConvertFunc")
+	}
+	converters.mx.Lock()
+	defer converters.mx.Unlock()
+	if converters.m[from] == nil {
+		converters.m[from] = make(map[string]ConvertFunc)
+	}
+	converters.m[from][to] = fn
+}
+
+// findPath finds the shortest chain of converters from one type to another.
+func findPath(from, to string) []ConvertFunc {
+	converters.mx.RLock()
+	defer converters.mx.RUnlock()
+	type step struct {
+		prev string
+		fn   ConvertFunc
+	}
+	visited := map[string]step{from: {}}
+	queue := []string{from}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		if cur == to {
+			var path []ConvertFunc
+			for x := to; x != from; x = visited[x].prev {
+				path = append([]ConvertFunc{visited[x].fn}, path...)
+			}
+			return path
+		}
+		for next, fn := range converters.m[cur] {
+			if _, ok := visited[next]; !ok {
+				visited[next] = step{cur, fn}
+				queue = append(queue, next)
+			}
+		}
+	}
+	return nil
+}
+
+// CanConvert returns true if content can be converted between the types.
+func CanConvert(from, to string) bool {
+	return from == to || findPath(from, to) != nil
+}
+
+// Convert content from one MIME type to another.
+// Returns ErrNoConverter if there is no way to convert.
+func Convert(content, from, to string) (string, error) {
+	if from == to {
+		return content, nil
+	}
+	path := findPath(from, to)
+	if path == nil {
+		return "", ErrNoConverter
+	}
+	for _, fn := range path {
+		var err error
+		content, err = fn(content)
+		if err != nil {
+			return "", err
+		}
+	}
+	return content, nil
+}
+
+// Fill adds the accepted MIME types missing from msg,
+// each converted from the first message in msg which can be converted.
+// Types which cannot be converted are skipped.
+// Returns the first conversion error, after attempting all the types.
+func Fill(msg *stdchat.MessageInfo, accept []string) error {
+	var firstErr error
+	for _, typ := range accept {
+		if msg.Get(typ).Valid() {
+			continue
+		}
+		for _, x := range *msg {
+			if !CanConvert(x.Type, typ) {
+				continue
+			}
+			content, err := Convert(x.Content, x.Type, typ)
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			msg.Set(typ, content)
+			break
+		}
+	}
+	return firstErr
+}
+
+type format struct {
+	parse  func(content string) []span
+	render func(spans []span) string
+}
+
+var builtinFormats = map[string]format{
+	Plain:    {parsePlain, renderPlain},
+	HTML:     {parseHTML, renderHTML},
+	Markdown: {parseMarkdown, renderMarkdown},
+	IRC:      {parseIRC, renderIRC},
+}
+
+func init() {
+	for from, ffrom := range builtinFormats {
+		for to, fto := range builtinFormats {
+			if from != to {
+				parse, render := ffrom.parse, fto.render
+				Register(from, to, func(content string) (string, error) {
+					return render(parse(content)), nil
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package richtext
+
+import (
+	"strings"
+)
+
+type style uint8
+
+const (
+	bold style = 1 << iota
+	italic
+	underline
+	strike
+	code
+)
+
+// span is a run of text with the same formatting,
+// the built-in formats convert through a list of spans.
+type span struct {
+	text  string
+	style style
+	link  string // URL, if a link.
+	color string // #RRGGBB, if colored.
+}
+
+func (x span) sameFormat(y span) bool {
+	return x.style == y.style && x.link == y.link && x.color == y.color
+}
+
+// spanBuilder builds a list of spans, merging text of the same format.
+type spanBuilder struct {
+	spans []span
+	cur   span
+	sb    strings.Builder
+}
+
+func (b *spanBuilder) flush() {
+	if b.sb.Len() > 0 {
+		x := b.cur
+		x.text = b.sb.String()
+		if n := len(b.spans); n > 0 && b.spans[n-1].sameFormat(x) {
+			b.spans[n-1].text += x.text
+		} else {
+			b.spans = append(b.spans, x)
+		}
+		b.sb.Reset()
+	}
+}
+
+// setFormat changes the format for text written after this.
+func (b *spanBuilder) setFormat(x span) {
+	if !b.cur.sameFormat(x) {
+		b.flush()
+		b.cur = x
+	}
+}
+
+func (b *spanBuilder) toggle(s style) {
+	x := b.cur
+	x.style ^= s
+	b.setFormat(x)
+}
+
+func (b *spanBuilder) writeString(s string) {
+	b.sb.WriteString(s)
+}
+
+func (b *spanBuilder) writeByte(c byte) {
+	b.sb.WriteByte(c)
+}
+
+func (b *spanBuilder) getSpans() []span {
+	b.flush()
+	return b.spans
+}
+
+func parsePlain(content string) []span {
+	if content == "" {
+		return nil
+	}
+	return []span{{text: content}}
+}
+
+// linkText returns the text for a link span when links cannot be represented.
+func linkText(x span) string {
+	if x.link == "" || x.link == x.text {
+		return x.text
+	}
+	return x.text + " (" + x.link + ")"
+}
+
+func renderPlain(spans []span) string {
+	sb := &strings.Builder{}
+	for _, x := range spans {
+		sb.WriteString(linkText(x))
+	}
+	return sb.String()
+}
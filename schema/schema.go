@@ -0,0 +1,298 @@
+// Package schema generates JSON Schema for the stdchat wire format.
+// The schema is generated from the Go types using reflection,
+// so it stays in lockstep with them.
+package schema
+
+import (
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"stdchat.org"
+)
+
+// Draft is the JSON Schema draft used.
+const Draft = "http://json-schema.org/draft-07/schema#"
+
+// Schema is a JSON Schema object.
+type Schema map[string]interface{}
+
+var (
+	timeType         = reflect.TypeOf(time.Time{})
+	messageType      = reflect.TypeOf(stdchat.Message{})
+	messageInfoType  = reflect.TypeOf(stdchat.MessageInfo{})
+	mediaInfoType    = reflect.TypeOf(stdchat.MediaInfo{})
+	stateEntryType   = reflect.TypeOf(stdchat.StateEntry{})
+	historyEntryType = reflect.TypeOf(stdchat.HistoryEntry{})
+)
+
+var stdchatPkgPath = messageType.PkgPath()
+
+// Generator generates JSON Schema definitions for Go types.
+// Struct fields are named by their json tags,
+// and fields without omitempty are required.
+type Generator struct {
+	defs       map[string]Schema
+	msgTypes   map[reflect.Type][]string // registered msg types per Go type.
+	stateTypes map[reflect.Type][]string // registered state types per Go type.
+	msgList    []reflect.Type            // Go types of msgs, in registration order.
+	stateList  []reflect.Type            // Go types of states, in registration order.
+}
+
+// NewGenerator creates a generator aware of the msg types registered
+// with stdchat.RegisterMsgType and the state types registered with
+// stdchat.RegisterStateType.
+func NewGenerator() *Generator {
+	g := &Generator{
+		defs:       make(map[string]Schema),
+		msgTypes:   make(map[reflect.Type][]string),
+		stateTypes: make(map[reflect.Type][]string),
+	}
+	for _, typ := range stdchat.MsgTypes() {
+		t := derefType(reflect.TypeOf(stdchat.LookupMsgType(typ)()))
+		if g.msgTypes[t] == nil {
+			g.msgList = append(g.msgList, t)
+		}
+		g.msgTypes[t] = append(g.msgTypes[t], typ)
+	}
+	for _, typ := range stdchat.StateTypes() {
+		t := derefType(reflect.TypeOf(stdchat.LookupStateType(typ)()))
+		if g.stateTypes[t] == nil {
+			g.stateList = append(g.stateList, t)
+		}
+		g.stateTypes[t] = append(g.stateTypes[t], typ)
+	}
+	return g
+}
+
+// Definitions returns the definitions referenced so far.
+func (g *Generator) Definitions() map[string]Schema {
+	return g.defs
+}
+
+// Define returns the schema for the type of v, see TypeSchema.
+func (g *Generator) Define(v interface{}) Schema {
+	return g.TypeSchema(reflect.TypeOf(v))
+}
+
+// TypeSchema returns the schema for t.
+// Named struct types are added to the definitions and a reference is returned.
+func (g *Generator) TypeSchema(t reflect.Type) Schema {
+	t = derefType(t)
+	switch t {
+	case timeType:
+		return Schema{"type": "string", "format": "date-time"}
+	case mediaInfoType: // MarshalJSON gives null if there is no URL.
+		return Schema{"anyOf": []interface{}{g.structRef(t), Schema{"type": "null"}}}
+	case stateEntryType:
+		return g.StateSchema()
+	case historyEntryType:
+		return g.MsgSchema()
+	}
+	var s Schema
+	switch t.Kind() {
+	case reflect.String:
+		s = Schema{"type": "string"}
+	case reflect.Bool:
+		s = Schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		s = Schema{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		s = Schema{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		s = Schema{"type": "number"}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			s = Schema{"type": []string{"string", "null"}, "contentEncoding": "base64"}
+		} else { // A nil slice is null.
+			s = Schema{"type": []string{"array", "null"}, "items": g.TypeSchema(t.Elem())}
+		}
+	case reflect.Array:
+		s = Schema{"type": "array", "items": g.TypeSchema(t.Elem()),
+			"minItems": t.Len(), "maxItems": t.Len()}
+	case reflect.Map: // A nil map is null.
+		s = Schema{"type": []string{"object", "null"},
+			"additionalProperties": g.TypeSchema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		return g.structRef(t)
+	default: // Interfaces and anything else can be any JSON.
+		s = Schema{}
+	}
+	if t == messageInfoType {
+		s["description"] = "The message in one or more MIME types."
+	}
+	return s
+}
+
+// MsgSchema returns the schema for any msg.
+// The registered msg types are constrained by their type field,
+// with ChatMsg, NetMsg and BaseMsg for msgs of any other type,
+// so a msg of a registered type must match the schema of that type.
+func (g *Generator) MsgSchema() Schema {
+	var list []interface{}
+	var registered []string
+	for _, t := range g.msgList {
+		list = append(list, g.structRef(t))
+		registered = append(registered, g.msgTypes[t]...)
+	}
+	var others []interface{}
+	for _, v := range []interface{}{stdchat.ChatMsg{}, stdchat.NetMsg{}, stdchat.BaseMsg{}} {
+		others = append(others, g.Define(v))
+	}
+	other := Schema{"anyOf": others}
+	if len(registered) != 0 {
+		other = Schema{"allOf": []interface{}{
+			Schema{"not": Schema{
+				"properties": Schema{"type": typePattern(registered)},
+				"required":   []string{"type"},
+			}},
+			other,
+		}}
+	}
+	return Schema{"anyOf": append(list, other)}
+}
+
+// StateSchema returns the schema for a state in a StateMsg.
+// The registered state types are constrained by their type field,
+// other states only need a type and proto.
+func (g *Generator) StateSchema() Schema {
+	var list []interface{}
+	for _, t := range g.stateList {
+		list = append(list, g.structRef(t))
+	}
+	list = append(list, Schema{
+		"type": "object",
+		"properties": Schema{
+			"type":  Schema{"type": "string"},
+			"proto": Schema{"type": "string"},
+		},
+		"required": []string{"type", "proto"},
+	})
+	return Schema{"anyOf": list}
+}
+
+// EnvelopeSchema returns the schema for a published msg, see stdchat.Envelope
+func (g *Generator) EnvelopeSchema() Schema {
+	return Schema{
+		"type": "object",
+		"properties": Schema{
+			"proto":   Schema{"type": "string"},
+			"net":     Schema{"type": "string"},
+			"chat":    Schema{"type": "string"},
+			"node":    Schema{"type": "string"},
+			"seq":     Schema{"type": "integer", "minimum": 0},
+			"payload": g.MsgSchema(),
+		},
+		"required": []string{"node", "payload"},
+	}
+}
+
+func derefType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+func typeName(t reflect.Type) string {
+	if t.PkgPath() == stdchatPkgPath {
+		return t.Name()
+	}
+	return path.Base(t.PkgPath()) + "." + t.Name()
+}
+
+func (g *Generator) structRef(t reflect.Type) Schema {
+	name := typeName(t)
+	if _, ok := g.defs[name]; !ok {
+		g.defs[name] = Schema{} // Placeholder for recursive types.
+		g.defs[name] = g.structSchema(t)
+	}
+	return Schema{"$ref": "#/definitions/" + name}
+}
+
+func (g *Generator) structSchema(t reflect.Type) Schema {
+	props := Schema{}
+	var required []string
+	g.addFields(t, props, &required)
+	types := append(append([]string(nil), g.msgTypes[t]...), g.stateTypes[t]...)
+	if len(types) != 0 {
+		props["type"] = typePattern(types)
+	} else if t == messageType {
+		props["type"] = Schema{"type": "string", "description": "MIME type",
+			"pattern": "^[^/]+/[^/]+$"}
+	} else if t == mediaInfoType {
+		props["type"] = Schema{"type": "string", "description": "MIME type, or hint such as image/*"}
+	}
+	s := Schema{"type": "object", "properties": props}
+	if len(required) != 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+// typePattern matches any of the types or their subtypes, see stdchat.IsType
+func typePattern(types []string) Schema {
+	quoted := make([]string, len(types))
+	for i, typ := range types {
+		quoted[i] = regexp.QuoteMeta(typ)
+	}
+	return Schema{"type": "string",
+		"pattern": "^(" + strings.Join(quoted, "|") + ")(/.*)?$"}
+}
+
+// addFields adds the JSON fields of struct t to props.
+// Fields of embedded structs are promoted unless already present.
+func (g *Generator) addFields(t reflect.Type, props Schema, required *[]string) {
+	var embedded []reflect.Type
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if icomma := strings.IndexByte(tag, ','); icomma != -1 {
+			name, opts = tag[:icomma], tag[icomma:]
+		}
+		if f.Anonymous && name == "" {
+			if ft := derefType(f.Type); ft.Kind() == reflect.Struct {
+				embedded = append(embedded, ft)
+			}
+			continue
+		}
+		if f.PkgPath != "" { // Unexported.
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if _, ok := props[name]; ok {
+			continue
+		}
+		props[name] = g.TypeSchema(f.Type)
+		if !strings.Contains(opts, ",omitempty") {
+			*required = append(*required, name)
+		}
+	}
+	for _, ft := range embedded {
+		g.addFields(ft, props, required)
+	}
+}
+
+// Generate returns the JSON Schema for the wire format,
+// the {proto, net, chat, node, seq, payload} envelope where the payload is any msg.
+// Also defines HistoryResult for the history API.
+func Generate() Schema {
+	g := NewGenerator()
+	s := g.EnvelopeSchema()
+	g.Define(stdchat.HistoryResult{})
+	s["$schema"] = Draft
+	s["title"] = "stdchat"
+	s["definitions"] = g.Definitions()
+	return s
+}
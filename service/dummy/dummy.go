@@ -10,7 +10,9 @@ import (
 )
 
 func NewService(tp service.Transporter) *service.Service {
-	return service.NewService(tp, NewClient)
+	svc := service.NewService(tp, NewClient)
+	svc.Formats = []string{"text/plain"}
+	return svc
 }
 
 func NewClient(svc *service.Service, addr, nick, pass string, values stdchat.ValuesInfo) (service.Networker, error) {
@@ -31,6 +33,9 @@ func NewClient(svc *service.Service, addr, nick, pass string, values stdchat.Val
 
 const Protocol = "dummy"
 
+var _ service.EditReceiver = &Client{}
+var _ service.ReactionReceiver = &Client{}
+
 type Client struct {
 	svc       *service.Service
 	tp        service.Transporter
@@ -67,16 +72,11 @@ func (client *Client) Handler(msg *stdchat.ChatMsg) {
 	case "msg", "msg/dummy.fakeMsg":
 		// Send outgoing msg back with all info.
 		outmsg := stdchat.ChatMsg{}
-		outmsg.Init(service.MakeID(msg.ID), "msg/dummy.fakeMsg", Protocol, client.NetworkID())
-		outmsg.From.Init(client.UserID(), "user")
-		outmsg.From.SetName(client.UserName(), "")
-		destID, destName := client.getUser(msg.Destination.GetName())
-		outmsg.Destination.Init(destID, "user")
-		outmsg.Destination.SetName(destName, "")
+		client.initOutMsg(&outmsg, msg, "msg/dummy.fakeMsg")
 		outmsg.Message.SetText(msg.GetMessageString())
-		client.tp.Publish(client.NetworkID(), outmsg.Destination.ID, "msg-out", outmsg)
+		client.tp.Publish(client.NetworkID(), outmsg.Destination.ID, "msg-out", &outmsg)
 		// Also have the recipient echo it, for dummy data:
-		client.publishFakeMsg(destName, "you said \""+msg.GetMessageString()+"\"")
+		client.publishFakeMsg(outmsg.Destination.GetName(), "you said \""+msg.GetMessageString()+"\"")
 	//case "msg/action", "msg/action/dummy.fakeAction":
 	//case "info", "info/dummy.fakeInfo":
 	default:
@@ -85,6 +85,45 @@ func (client *Client) Handler(msg *stdchat.ChatMsg) {
 	}
 }
 
+// initOutMsg initializes outmsg as sent by myself in response to msg.
+func (client *Client) initOutMsg(outmsg *stdchat.ChatMsg, msg *stdchat.ChatMsg, typ string) {
+	outmsg.Init(service.MakeID(msg.ID), typ, Protocol, client.NetworkID())
+	outmsg.From.Init(client.UserID(), "user")
+	outmsg.From.SetName(client.UserName(), "")
+	destID, destName := client.getUser(msg.Destination.GetName())
+	outmsg.Destination.Init(destID, "user")
+	outmsg.Destination.SetName(destName, "")
+}
+
+func (client *Client) EditHandler(msg *stdchat.MsgEditedMsg) {
+	// Pretend the edit happened.
+	outmsg := stdchat.MsgEditedMsg{}
+	client.initOutMsg(&outmsg.ChatMsg, &msg.ChatMsg, "msg-edited")
+	outmsg.Message.SetText(msg.GetMessageString())
+	outmsg.MsgID = msg.MsgID
+	outmsg.Reason = msg.Reason
+	client.tp.Publish(client.NetworkID(), outmsg.Destination.ID, "msg-edited", &outmsg)
+}
+
+func (client *Client) DeleteHandler(msg *stdchat.MsgDeletedMsg) {
+	// Pretend the delete happened.
+	outmsg := stdchat.MsgDeletedMsg{}
+	client.initOutMsg(&outmsg.ChatMsg, &msg.ChatMsg, "msg-deleted")
+	outmsg.MsgID = msg.MsgID
+	outmsg.Reason = msg.Reason
+	client.tp.Publish(client.NetworkID(), outmsg.Destination.ID, "msg-deleted", &outmsg)
+}
+
+func (client *Client) ReactionHandler(msg *stdchat.ReactionMsg) {
+	// Pretend the reaction happened.
+	outmsg := stdchat.ReactionMsg{}
+	client.initOutMsg(&outmsg.ChatMsg, &msg.ChatMsg, "reaction")
+	outmsg.MsgID = msg.MsgID
+	outmsg.Emoji = msg.Emoji
+	outmsg.Remove = msg.Remove
+	client.tp.Publish(client.NetworkID(), outmsg.Destination.ID, "reaction", &outmsg)
+}
+
 func (client *Client) CmdHandler(msg *stdchat.CmdMsg) {
 	client.tp.PublishError(msg.ID, msg.Network.ID,
 		errors.New("unhandled command: "+msg.Command))
@@ -102,7 +141,7 @@ func (client *Client) publishFakeMsg(from, msgText string) {
 	msg.From.SetName(fromName, "")
 	msg.Destination = msg.From
 	msg.Message.SetText(msgText)
-	client.tp.Publish(client.NetworkID(), msg.Destination.ID, "msg", msg)
+	client.tp.Publish(client.NetworkID(), msg.Destination.ID, "msg", &msg)
 }
 
 func (client *Client) Start(ctx context.Context, id string) error {
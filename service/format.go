@@ -0,0 +1,95 @@
+package service
+
+import (
+	"reflect"
+	"sync"
+
+	"stdchat.org"
+	"stdchat.org/richtext"
+)
+
+// FormatAccepter accepts msg formats (MIME types) requested by clients.
+type FormatAccepter interface {
+	AcceptFormats(msgTypes ...string)
+	AcceptedFormats() []string
+}
+
+// FillFormats returns the msg payload with the accepted formats filled in,
+// converting from the formats in the msg, see richtext.Fill
+// The payload is not modified, a shallow copy is returned if any are filled in,
+// so a payload published to several clients can be filled in for each client.
+// Only payloads which are pointers to msgs are filled in.
+func FillFormats(payload interface{}, accept []string) interface{} {
+	if len(accept) == 0 {
+		return payload
+	}
+	msg, ok := payload.(stdchat.BaseMsger)
+	if !ok {
+		return payload
+	}
+	v := reflect.ValueOf(payload)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return payload
+	}
+	orig := msg.GetBaseMsg().Message
+	message := append(stdchat.MessageInfo(nil), orig...)
+	// Conversion errors are not fatal, publish what we have.
+	_ = richtext.Fill(&message, accept)
+	if len(message) == len(orig) {
+		return payload // Nothing filled in.
+	}
+	cp := reflect.New(v.Type().Elem())
+	cp.Elem().Set(v.Elem())
+	cmsg := cp.Interface().(stdchat.BaseMsger)
+	cmsg.GetBaseMsg().Message = message
+	return cmsg
+}
+
+// FormatTransport is a Transporter which fills in the msg formats
+// accepted by its client, see FillFormats.
+// The accepted formats apply to all the msgs published on this transport,
+// the provider instead handles accept-formats for each connection.
+// It is thread safe.
+type FormatTransport struct {
+	Transporter
+	mx     sync.RWMutex
+	accept []string // locked by mx
+}
+
+var _ Transporter = &FormatTransport{}
+var _ FormatAccepter = &FormatTransport{}
+
+// AcceptFormats adds to the accepted formats.
+func (tp *FormatTransport) AcceptFormats(msgTypes ...string) {
+	tp.mx.Lock()
+	defer tp.mx.Unlock()
+	tp.accept = AddFormats(tp.accept, msgTypes...)
+}
+
+func (tp *FormatTransport) AcceptedFormats() []string {
+	tp.mx.RLock()
+	defer tp.mx.RUnlock()
+	return append([]string(nil), tp.accept...)
+}
+
+func (tp *FormatTransport) Publish(network, chat, node string, payload interface{}) error {
+	payload = FillFormats(payload, tp.AcceptedFormats())
+	return tp.Transporter.Publish(network, chat, node, payload)
+}
+
+// AddFormats adds the msg types to the accepted formats, without duplicates.
+func AddFormats(accept []string, msgTypes ...string) []string {
+	for _, typ := range msgTypes {
+		found := false
+		for _, x := range accept {
+			if x == typ {
+				found = true
+				break
+			}
+		}
+		if !found {
+			accept = append(accept, typ)
+		}
+	}
+	return accept
+}
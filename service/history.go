@@ -0,0 +1,170 @@
+package service
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"sync"
+
+	"stdchat.org"
+)
+
+var ErrHistoryIDNotFound = errors.New("history msg ID not found")
+
+// HistoryStorer stores chat history to be served by the history API.
+// Networker implementations add msgs to it as they are published.
+type HistoryStorer interface {
+	AddHistory(network, chat string, msg stdchat.BaseMsger) error
+	QueryHistory(network, chat string, q stdchat.HistoryQuery) (stdchat.HistoryResult, error)
+}
+
+// FilterHistory applies the query to list, which is in chronological order.
+// Returns ErrHistoryIDNotFound if the query's beforeID or afterID is not in list.
+func FilterHistory(list []stdchat.BaseMsger, q stdchat.HistoryQuery) (stdchat.HistoryResult, error) {
+	result := stdchat.HistoryResult{List: []stdchat.HistoryEntry{}}
+	istart, iend := 0, len(list)
+	if q.AfterID != "" {
+		i := findHistoryID(list, q.AfterID)
+		if i == -1 {
+			return result, ErrHistoryIDNotFound
+		}
+		istart = i + 1
+	}
+	if q.BeforeID != "" {
+		i := findHistoryID(list, q.BeforeID)
+		if i == -1 {
+			return result, ErrHistoryIDNotFound
+		}
+		iend = i
+	}
+	var matches []stdchat.BaseMsger
+	for i := istart; i < iend; i++ {
+		if q.Match(list[i]) {
+			matches = append(matches, list[i])
+		}
+	}
+	limit := q.GetLimit()
+	if len(matches) > limit {
+		result.More = true
+		if q.Backward() {
+			matches = matches[len(matches)-limit:]
+		} else {
+			matches = matches[:limit]
+		}
+	}
+	for _, msg := range matches {
+		result.List = append(result.List, stdchat.HistoryEntry{BaseMsger: msg})
+	}
+	return result, nil
+}
+
+func findHistoryID(list []stdchat.BaseMsger, id string) int {
+	for i := len(list) - 1; i >= 0; i-- {
+		if list[i].GetID() == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// MemHistory is an in-memory HistoryStorer.
+// It is thread safe.
+type MemHistory struct {
+	MaxPerChat int // 0 for 1000
+	mx         sync.RWMutex
+	chats      map[string][]stdchat.BaseMsger // locked by mx
+}
+
+var _ HistoryStorer = &MemHistory{}
+
+func memHistoryKey(network, chat string) string {
+	return network + "\x00" + chat
+}
+
+func (h *MemHistory) AddHistory(network, chat string, msg stdchat.BaseMsger) error {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	if h.chats == nil {
+		h.chats = make(map[string][]stdchat.BaseMsger)
+	}
+	max := h.MaxPerChat
+	if max <= 0 {
+		max = 1000
+	}
+	key := memHistoryKey(network, chat)
+	list := append(h.chats[key], msg)
+	if len(list) > max {
+		list = append([]stdchat.BaseMsger(nil), list[len(list)-max:]...)
+	}
+	h.chats[key] = list
+	return nil
+}
+
+func (h *MemHistory) QueryHistory(network, chat string, q stdchat.HistoryQuery) (stdchat.HistoryResult, error) {
+	h.mx.RLock()
+	defer h.mx.RUnlock()
+	return FilterHistory(h.chats[memHistoryKey(network, chat)], q)
+}
+
+// RemoveHistory removes all the history for the chat.
+func (h *MemHistory) RemoveHistory(network, chat string) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	delete(h.chats, memHistoryKey(network, chat))
+}
+
+// HistoryHandler serves the history API for a chat.
+type HistoryHandler struct {
+	Store   HistoryStorer
+	Network string
+	Chat    string
+}
+
+func (hh *HistoryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := stdchat.ParseHistoryQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result, err := hh.Store.QueryHistory(hh.Network, hh.Chat, q)
+	if err != nil {
+		if err == ErrHistoryIDNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	j, err := stdchat.JSON.Marshal(&result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+func historyPathSuffix(chat string) string {
+	// Encoded so the chat ID is path safe and cannot prefix another chat.
+	return "history/" + base64.RawURLEncoding.EncodeToString([]byte(chat)) + "/"
+}
+
+// ServeHistory serves the history API for the chat on the transport,
+// returns the HistoryURL to use in SubscribeMsg and SubscriptionStateInfo.
+// Use StopServeHistory when unsubscribed.
+func ServeHistory(tp Transporter, store HistoryStorer, network, chat string) (string, error) {
+	return tp.ServeURL(network, historyPathSuffix(chat), &HistoryHandler{
+		Store:   store,
+		Network: network,
+		Chat:    chat,
+	})
+}
+
+// StopServeHistory stops serving the history API for the chat.
+func StopServeHistory(tp Transporter, network, chat string) {
+	tp.StopServeURL(network, historyPathSuffix(chat))
+}
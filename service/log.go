@@ -0,0 +1,419 @@
+package service
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"stdchat.org"
+)
+
+// SyncPolicy is when a LogTransport syncs writes to disk.
+type SyncPolicy int
+
+const (
+	SyncPeriodic SyncPolicy = iota // every SyncInterval (default)
+	SyncAlways                     // after every msg
+	SyncNever                      // leave it to the OS
+)
+
+const (
+	DefaultLogSegmentSize  = 16 << 20
+	DefaultLogSyncInterval = time.Second
+)
+
+var ErrLogClosed = errors.New("log closed")
+
+// ErrSeqNotFound means the log no longer goes back far enough,
+// the msgs were removed by the retention policy.
+var ErrSeqNotFound = errors.New("sequence not found in log")
+
+// LogEntry is a msg in a LogTransport, see Replay.
+// The Seq is always set.
+type LogEntry struct {
+	Time time.Time `json:"time"`
+	stdchat.RawEnvelope
+}
+
+type logRecord struct {
+	Time time.Time `json:"time"`
+	stdchat.Envelope
+}
+
+// LogTransport is a transport recording every published msg
+// to an append-only log on disk, each with a monotonic sequence number.
+// Use it along with other transports in a MultiTransport,
+// and use Replay to get the msgs after a sequence number.
+// The log is a directory of segment files of newline-delimited JSON,
+// each segment is named by its first sequence number.
+// Dir is required, all other fields are optional. Advertise opens the log.
+// It is thread safe.
+type LogTransport struct {
+	Protocol     string
+	Dir          string
+	SegmentSize  int64         // start a new segment after this size.
+	Sync         SyncPolicy    // when to sync writes to disk.
+	SyncInterval time.Duration // for SyncPeriodic.
+	MaxSegments  int           // remove the oldest segments past this, if set.
+	MaxAge       time.Duration // remove segments older than this, if set.
+	WebServer
+	mx       sync.Mutex
+	f        *os.File // current segment, locked by mx
+	fsize    int64    // locked by mx
+	seq      uint64   // last sequence number, locked by mx
+	dirty    bool     // unsynced writes, locked by mx
+	closed   bool     // locked by mx
+	stopSync chan struct{}
+}
+
+var _ Transporter = &LogTransport{}
+
+func (tp *LogTransport) GetProtocol() string {
+	return tp.Protocol
+}
+
+// Advertise opens the log, continuing from the last sequence number.
+func (tp *LogTransport) Advertise() error {
+	if tp.Dir == "" {
+		return errors.New("log dir required")
+	}
+	if tp.Protocol == "" {
+		tp.Protocol = "protocol"
+	}
+	if tp.SegmentSize <= 0 {
+		tp.SegmentSize = DefaultLogSegmentSize
+	}
+	if tp.SyncInterval <= 0 {
+		tp.SyncInterval = DefaultLogSyncInterval
+	}
+	if err := os.MkdirAll(tp.Dir, 0700); err != nil {
+		return err
+	}
+	tp.mx.Lock()
+	defer tp.mx.Unlock()
+	if tp.f != nil {
+		return nil // Already open.
+	}
+	segs, err := tp.segments()
+	if err != nil {
+		return err
+	}
+	if len(segs) == 0 {
+		if err := tp.newSegment(1); err != nil {
+			return err
+		}
+	} else {
+		last := segs[len(segs)-1]
+		f, size, seq, err := recoverSegment(tp.segmentPath(last), last)
+		if err != nil {
+			return err
+		}
+		tp.f, tp.fsize, tp.seq = f, size, seq
+	}
+	tp.retain()
+	if tp.Sync == SyncPeriodic {
+		tp.stopSync = make(chan struct{})
+		go tp.syncLoop(tp.stopSync)
+	}
+	return nil
+}
+
+func (tp *LogTransport) segmentPath(firstSeq uint64) string {
+	return filepath.Join(tp.Dir, fmt.Sprintf("%020d.log", firstSeq))
+}
+
+// segments returns the first sequence numbers of the segments, in order.
+func (tp *LogTransport) segments() ([]uint64, error) {
+	fis, err := ioutil.ReadDir(tp.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var segs []uint64
+	for _, fi := range fis {
+		name := fi.Name()
+		if !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, ".log"), 10, 64)
+		if err == nil && seq > 0 {
+			segs = append(segs, seq)
+		}
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i] < segs[j] })
+	return segs, nil
+}
+
+// recoverSegment opens a segment for appending,
+// truncating an incomplete last line, such as from a crash.
+func recoverSegment(path string, firstSeq uint64) (*os.File, int64, uint64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	seq := firstSeq - 1
+	var good int64
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			break // Anything after the last newline is incomplete.
+		}
+		var rec struct {
+			Seq uint64 `json:"seq"`
+		}
+		if stdchat.JSON.Unmarshal(line, &rec) != nil || rec.Seq <= seq {
+			break
+		}
+		seq = rec.Seq
+		good += int64(len(line))
+	}
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, 0, 0, err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, 0, 0, err
+	}
+	return f, good, seq, nil
+}
+
+// newSegment starts a new segment, call with mx locked.
+func (tp *LogTransport) newSegment(firstSeq uint64) error {
+	f, err := os.OpenFile(tp.segmentPath(firstSeq),
+		os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if tp.Sync != SyncNever {
+		// The new file is not durable until its directory entry is.
+		if err := syncDir(tp.Dir); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if tp.f != nil {
+		tp.f.Sync()
+		tp.f.Close()
+	}
+	tp.f, tp.fsize, tp.dirty = f, 0, false
+	tp.seq = firstSeq - 1
+	return nil
+}
+
+// syncDir syncs the directory entries to disk, such as a created file.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil // Directories cannot be synced, NTFS journals the entries.
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// retain removes segments past MaxSegments or MaxAge,
+// never the current segment. Call with mx locked.
+func (tp *LogTransport) retain() {
+	if tp.MaxSegments <= 0 && tp.MaxAge <= 0 {
+		return
+	}
+	segs, err := tp.segments()
+	if err != nil || len(segs) < 2 {
+		return
+	}
+	old := segs[:len(segs)-1]
+	for i, seg := range old {
+		path := tp.segmentPath(seg)
+		remove := tp.MaxSegments > 0 && len(segs)-i > tp.MaxSegments
+		if !remove && tp.MaxAge > 0 {
+			// The segment is only as old as its last write.
+			if fi, err := os.Stat(path); err == nil && time.Since(fi.ModTime()) > tp.MaxAge {
+				remove = true
+			}
+		}
+		if !remove {
+			break
+		}
+		os.Remove(path)
+	}
+}
+
+func (tp *LogTransport) syncLoop(stop chan struct{}) {
+	ticker := time.NewTicker(tp.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			tp.mx.Lock()
+			if tp.dirty && tp.f != nil {
+				tp.f.Sync()
+				tp.dirty = false
+			}
+			tp.mx.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Append adds the msg to the log, returns its sequence number.
+func (tp *LogTransport) Append(topic stdchat.Topic, payload interface{}) (uint64, error) {
+	tp.mx.Lock()
+	defer tp.mx.Unlock()
+	if tp.closed || tp.f == nil {
+		return 0, ErrLogClosed
+	}
+	if tp.fsize >= tp.SegmentSize {
+		if err := tp.newSegment(tp.seq + 1); err != nil {
+			return 0, err
+		}
+		tp.retain()
+	}
+	rec := &logRecord{Time: time.Now(),
+		Envelope: stdchat.Envelope{Topic: topic, Seq: tp.seq + 1, Payload: payload}}
+	b, err := stdchat.JSON.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+	n, err := tp.f.Write(append(b, '\n'))
+	tp.fsize += int64(n)
+	if err != nil {
+		return 0, err
+	}
+	tp.seq = rec.Seq
+	if tp.Sync == SyncAlways {
+		if err := tp.f.Sync(); err != nil {
+			return 0, err
+		}
+	} else {
+		tp.dirty = true
+	}
+	return rec.Seq, nil
+}
+
+// LastSeq returns the sequence number of the last msg, or 0 if none.
+func (tp *LogTransport) LastSeq() uint64 {
+	tp.mx.Lock()
+	defer tp.mx.Unlock()
+	return tp.seq
+}
+
+// Replay calls fn for each msg after the sequence number, in order,
+// up to the last msg at the time of the call.
+// Returns ErrSeqNotFound if the msgs after seq are no longer in the log.
+// Stops and returns the error if fn returns an error.
+func (tp *LogTransport) Replay(after uint64, fn func(entry *LogEntry) error) error {
+	last := tp.LastSeq()
+	if after >= last {
+		return nil
+	}
+	segs, err := tp.segments()
+	if err != nil {
+		return err
+	}
+	if len(segs) == 0 || segs[0] > after+1 {
+		return ErrSeqNotFound
+	}
+	for i, seg := range segs {
+		if i+1 < len(segs) && segs[i+1] <= after+1 {
+			continue // All before after.
+		}
+		done, err := tp.replaySegment(seg, after, last, fn)
+		if err != nil || done {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tp *LogTransport) replaySegment(seg, after, last uint64,
+	fn func(entry *LogEntry) error) (bool, error) {
+	f, err := os.Open(tp.segmentPath(seg))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, ErrSeqNotFound // Removed by retention.
+		}
+		return false, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF {
+				return false, nil
+			}
+			return false, err
+		}
+		entry := &LogEntry{}
+		if err := stdchat.JSON.Unmarshal(line, entry); err != nil {
+			return false, err
+		}
+		if entry.Seq <= after {
+			continue
+		}
+		if entry.Seq > last {
+			return true, nil
+		}
+		if err := fn(entry); err != nil {
+			return true, err
+		}
+		if entry.Seq == last {
+			return true, nil
+		}
+	}
+}
+
+func (tp *LogTransport) Publish(network, chat, node string, payload interface{}) error {
+	topic := stdchat.Topic{Protocol: tp.Protocol, Network: network, Chat: chat, Node: node}
+	_, err := tp.Append(topic, payload)
+	return err
+}
+
+func (tp *LogTransport) PublishError(id string, network string, err error) error {
+	msg := &stdchat.NetMsg{}
+	msg.Init(id, "error", tp.Protocol, network)
+	msg.Message.SetText(err.Error())
+	return tp.Publish(network, "", "error", msg)
+}
+
+// Close syncs and closes the log.
+func (tp *LogTransport) Close() error {
+	tp.mx.Lock()
+	defer tp.mx.Unlock()
+	if tp.closed {
+		return nil
+	}
+	tp.closed = true
+	if tp.stopSync != nil {
+		close(tp.stopSync)
+	}
+	var err error
+	if tp.f != nil {
+		err = tp.f.Sync()
+		if cerr := tp.f.Close(); err == nil {
+			err = cerr
+		}
+		tp.f = nil
+	}
+	if werr := tp.WebServer.Close(); err == nil {
+		err = werr
+	}
+	return err
+}
@@ -0,0 +1,250 @@
+package service_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"stdchat.org"
+	"stdchat.org/service"
+)
+
+func tempLogDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "stdchat-log-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func openLog(t *testing.T, tp *service.LogTransport) *service.LogTransport {
+	t.Helper()
+	if err := tp.Advertise(); err != nil {
+		t.Fatal(err)
+	}
+	return tp
+}
+
+func appendMsgs(t *testing.T, tp *service.LogTransport, first, last int) {
+	t.Helper()
+	for i := first; i <= last; i++ {
+		msg := &stdchat.ChatMsg{}
+		msg.Init(strconv.Itoa(i), "msg/text", "test", "net1")
+		msg.Destination.Init("#chan", "group")
+		msg.Message.SetText("hello " + strconv.Itoa(i))
+		if err := tp.Publish("net1", "#chan", "msg", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// replayIDs returns the seq of each replayed msg, checking it matches the msg ID.
+func replayIDs(t *testing.T, tp *service.LogTransport, after uint64) ([]uint64, error) {
+	t.Helper()
+	var seqs []uint64
+	err := tp.Replay(after, func(entry *service.LogEntry) error {
+		if entry.Topic.Node != "msg" || entry.Topic.Chat != "#chan" || entry.Time.IsZero() {
+			t.Errorf("unexpected entry %d: %+v", entry.Seq, entry.Topic)
+		}
+		var msg stdchat.ChatMsg
+		if err := stdchat.JSON.Unmarshal(entry.Payload, &msg); err != nil {
+			return err
+		}
+		if msg.ID != strconv.FormatUint(entry.Seq, 10) {
+			t.Errorf("entry %d has msg %s", entry.Seq, msg.ID)
+		}
+		seqs = append(seqs, entry.Seq)
+		return nil
+	})
+	return seqs, err
+}
+
+func seqRange(first, last uint64) []uint64 {
+	var seqs []uint64
+	for seq := first; seq <= last; seq++ {
+		seqs = append(seqs, seq)
+	}
+	return seqs
+}
+
+func logSegments(t *testing.T, dir string) []string {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names // sorted
+}
+
+func TestLogReplay(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+	tp := openLog(t, &service.LogTransport{Dir: dir, SegmentSize: 500, Sync: service.SyncNever})
+	defer tp.Close()
+
+	if seqs, err := replayIDs(t, tp, 0); err != nil || len(seqs) != 0 {
+		t.Fatalf("empty log replayed %v %v", seqs, err)
+	}
+	appendMsgs(t, tp, 1, 20)
+	if tp.LastSeq() != 20 {
+		t.Fatalf("LastSeq %d, expected 20", tp.LastSeq())
+	}
+	if n := len(logSegments(t, dir)); n < 3 {
+		t.Fatalf("expected several segments, got %d", n)
+	}
+	for _, after := range []uint64{0, 1, 5, 10, 19, 20, 100} {
+		seqs, err := replayIDs(t, tp, after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := seqRange(after+1, 20); !reflect.DeepEqual(seqs, want) {
+			t.Errorf("replay after %d: got %v, want %v", after, seqs, want)
+		}
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	err := tp.Replay(3, func(entry *service.LogEntry) error {
+		n++
+		if entry.Seq == 6 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || n != 3 {
+		t.Errorf("replay should stop on error, got %v after %d", err, n)
+	}
+}
+
+func TestLogRecoverTruncated(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+	tp := openLog(t, &service.LogTransport{Dir: dir, SegmentSize: 500, Sync: service.SyncAlways})
+	appendMsgs(t, tp, 1, 10)
+	if err := tp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tp.Publish("net1", "#chan", "msg", nil); err != service.ErrLogClosed {
+		t.Errorf("publish after close: got %v, want %v", err, service.ErrLogClosed)
+	}
+
+	// Simulate a crash in the middle of writing the last record.
+	segs := logSegments(t, dir)
+	last := segs[len(segs)-1]
+	data, err := ioutil.ReadFile(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(last, data[:len(data)-10], 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tp = openLog(t, &service.LogTransport{Dir: dir, SegmentSize: 500, Sync: service.SyncAlways})
+	if tp.LastSeq() != 9 {
+		t.Fatalf("LastSeq after recovery %d, expected 9", tp.LastSeq())
+	}
+	seqs, err := replayIDs(t, tp, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := seqRange(1, 9); !reflect.DeepEqual(seqs, want) {
+		t.Errorf("replay after recovery: got %v, want %v", seqs, want)
+	}
+
+	// The partial record is gone, appending continues from the last good one.
+	appendMsgs(t, tp, 10, 12)
+	seqs, err = replayIDs(t, tp, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := seqRange(9, 12); !reflect.DeepEqual(seqs, want) {
+		t.Errorf("replay after appending: got %v, want %v", seqs, want)
+	}
+	if err := tp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A corrupt complete line is also cut off, along with anything after it.
+	segs = logSegments(t, dir)
+	last = segs[len(segs)-1]
+	data, err = ioutil.ReadFile(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	if len(lines) < 3 {
+		t.Fatalf("expected more lines in the last segment: %q", data)
+	}
+	lines[len(lines)-3] = "{garbage\n"
+	if err := ioutil.WriteFile(last, []byte(strings.Join(lines, "")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tp = openLog(t, &service.LogTransport{Dir: dir, SegmentSize: 500, Sync: service.SyncAlways})
+	defer tp.Close()
+	if tp.LastSeq() != 10 {
+		t.Fatalf("LastSeq after recovery %d, expected 10", tp.LastSeq())
+	}
+	seqs, err = replayIDs(t, tp, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := seqRange(1, 10); !reflect.DeepEqual(seqs, want) {
+		t.Errorf("replay after recovery: got %v, want %v", seqs, want)
+	}
+}
+
+func TestLogRetention(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+	tp := openLog(t, &service.LogTransport{Dir: dir, SegmentSize: 500,
+		MaxSegments: 2, Sync: service.SyncNever})
+	appendMsgs(t, tp, 1, 30)
+	if n := len(logSegments(t, dir)); n != 2 {
+		t.Fatalf("expected 2 segments, got %d", n)
+	}
+	if _, err := replayIDs(t, tp, 0); err != service.ErrSeqNotFound {
+		t.Errorf("replay of pruned msgs: got %v, want %v", err, service.ErrSeqNotFound)
+	}
+	seqs, err := replayIDs(t, tp, 28)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := seqRange(29, 30); !reflect.DeepEqual(seqs, want) {
+		t.Errorf("replay of retained msgs: got %v, want %v", seqs, want)
+	}
+	if err := tp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Segments past MaxAge are removed when reopened, except the current one.
+	old := time.Now().Add(-2 * time.Hour)
+	for _, seg := range logSegments(t, dir) {
+		if err := os.Chtimes(seg, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tp = openLog(t, &service.LogTransport{Dir: dir, SegmentSize: 500,
+		MaxAge: time.Hour, Sync: service.SyncNever})
+	defer tp.Close()
+	if n := len(logSegments(t, dir)); n != 1 {
+		t.Fatalf("expected 1 segment, got %d", n)
+	}
+	if tp.LastSeq() != 30 {
+		t.Fatalf("LastSeq %d, expected 30", tp.LastSeq())
+	}
+	appendMsgs(t, tp, 31, 31)
+	seqs, err = replayIDs(t, tp, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := seqRange(31, 31); !reflect.DeepEqual(seqs, want) {
+		t.Errorf("replay after age retention: got %v, want %v", seqs, want)
+	}
+}
@@ -0,0 +1,132 @@
+package mqtt
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"stdchat.org"
+)
+
+var ErrClientClosed = errors.New("mqtt client closed")
+
+// Broker is a minimal in-process stand-in for an MQTT broker,
+// such as for testing without a network.
+// Msgs are delivered synchronously to the subscribers, in the publisher's goroutine.
+// QoS levels and retained msgs are not supported.
+// It is thread safe.
+type Broker struct {
+	mx   sync.RWMutex
+	subs []*subscription // locked by mx
+}
+
+type subscription struct {
+	client  *BrokerClient
+	pattern string
+	handler func(topic string, payload []byte)
+}
+
+// NewClient returns a new client connected to the broker.
+func (b *Broker) NewClient() *BrokerClient {
+	return &BrokerClient{broker: b}
+}
+
+// Publish the payload to subscribers of the topic name.
+func (b *Broker) Publish(topic string, payload []byte) error {
+	if topic == "" || strings.ContainsAny(topic, "+#") {
+		return errors.New("invalid topic name: " + topic)
+	}
+	b.mx.RLock()
+	var matched []*subscription
+	for _, sub := range b.subs {
+		if stdchat.MatchTopic(sub.pattern, topic) {
+			matched = append(matched, sub)
+		}
+	}
+	b.mx.RUnlock()
+	for _, sub := range matched {
+		sub.handler(topic, payload)
+	}
+	return nil
+}
+
+func (b *Broker) subscribe(sub *subscription) error {
+	if !stdchat.ValidTopicPattern(sub.pattern) {
+		return errors.New("invalid topic pattern: " + sub.pattern)
+	}
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	for i, x := range b.subs {
+		if x.client == sub.client && x.pattern == sub.pattern {
+			b.subs[i] = sub // Replace the existing subscription.
+			return nil
+		}
+	}
+	b.subs = append(b.subs, sub)
+	return nil
+}
+
+// unsubscribe the client from the pattern, or all if pattern is empty.
+func (b *Broker) unsubscribe(client *BrokerClient, pattern string) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	subs := b.subs[:0]
+	for _, x := range b.subs {
+		if x.client != client || (pattern != "" && x.pattern != pattern) {
+			subs = append(subs, x)
+		}
+	}
+	for i := len(subs); i < len(b.subs); i++ {
+		b.subs[i] = nil
+	}
+	b.subs = subs
+}
+
+// BrokerClient is a Client connected to a Broker.
+type BrokerClient struct {
+	broker *Broker
+	mx     sync.RWMutex
+	closed bool // locked by mx
+}
+
+var _ Client = &BrokerClient{}
+
+func (client *BrokerClient) isClosed() bool {
+	client.mx.RLock()
+	defer client.mx.RUnlock()
+	return client.closed
+}
+
+func (client *BrokerClient) Publish(topic string, payload []byte) error {
+	if client.isClosed() {
+		return ErrClientClosed
+	}
+	return client.broker.Publish(topic, payload)
+}
+
+func (client *BrokerClient) Subscribe(pattern string, handler func(topic string, payload []byte)) error {
+	if client.isClosed() {
+		return ErrClientClosed
+	}
+	return client.broker.subscribe(&subscription{client, pattern, handler})
+}
+
+func (client *BrokerClient) Unsubscribe(pattern string) error {
+	if client.isClosed() {
+		return ErrClientClosed
+	}
+	if pattern == "" {
+		return errors.New("invalid topic pattern")
+	}
+	client.broker.unsubscribe(client, pattern)
+	return nil
+}
+
+// Close disconnects from the broker, removing all subscriptions.
+func (client *BrokerClient) Close() error {
+	client.mx.Lock()
+	client.closed = true
+	client.mx.Unlock()
+	client.broker.unsubscribe(client, "")
+	return nil
+}
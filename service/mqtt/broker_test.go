@@ -0,0 +1,192 @@
+package mqtt_test
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"stdchat.org/service/mqtt"
+)
+
+// recorder records the msgs received by a subscription.
+type recorder struct {
+	mx   sync.Mutex
+	msgs []string // "topic payload"
+}
+
+func (r *recorder) handle(topic string, payload []byte) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.msgs = append(r.msgs, topic+" "+string(payload))
+}
+
+func (r *recorder) take() []string {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	msgs := r.msgs
+	r.msgs = nil
+	return msgs
+}
+
+func expectMsgs(t *testing.T, name string, r *recorder, want ...string) {
+	t.Helper()
+	if got := r.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: got %q, want %q", name, got, want)
+	}
+}
+
+func TestBrokerPublishSubscribe(t *testing.T) {
+	broker := &mqtt.Broker{}
+	pub := broker.NewClient()
+	defer pub.Close()
+	sub := broker.NewClient()
+	defer sub.Close()
+
+	var exact, other recorder
+	if err := sub.Subscribe("chat/p/net1/%23c/msg", exact.handle); err != nil {
+		t.Fatal(err)
+	}
+	if err := sub.Subscribe("chat/p/net2/x/msg", other.handle); err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Publish("chat/p/net1/%23c/msg", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Publish("chat/p/net1/%23c/msg/text", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	expectMsgs(t, "exact", &exact, "chat/p/net1/%23c/msg 1")
+	expectMsgs(t, "other", &other)
+
+	// The publisher also receives its own msgs if subscribed.
+	var self recorder
+	if err := pub.Subscribe("chat/p/net2/x/msg", self.handle); err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Publish("chat/p/net2/x/msg", []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	expectMsgs(t, "self", &self, "chat/p/net2/x/msg 3")
+	expectMsgs(t, "other", &other, "chat/p/net2/x/msg 3")
+
+	// Subscribing to the same pattern again replaces the handler.
+	var replaced recorder
+	if err := sub.Subscribe("chat/p/net2/x/msg", replaced.handle); err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Publish("chat/p/net2/x/msg", []byte("4")); err != nil {
+		t.Fatal(err)
+	}
+	expectMsgs(t, "other", &other)
+	expectMsgs(t, "replaced", &replaced, "chat/p/net2/x/msg 4")
+	expectMsgs(t, "self", &self, "chat/p/net2/x/msg 4")
+
+	for _, topic := range []string{"", "chat/+/x", "chat/#"} {
+		if err := pub.Publish(topic, nil); err == nil {
+			t.Errorf("publish to invalid topic name %q should fail", topic)
+		}
+	}
+}
+
+func TestBrokerWildcards(t *testing.T) {
+	broker := &mqtt.Broker{}
+	client := broker.NewClient()
+	defer client.Close()
+
+	patterns := []string{
+		"chat/+/+/+/msg",
+		"chat/+/+/+/msg/#",
+		"chat/p/net1/#",
+		"chat/+/+/+/+",
+		"#",
+	}
+	recs := make([]recorder, len(patterns))
+	for i, pattern := range patterns {
+		if err := client.Subscribe(pattern, recs[i].handle); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, topic := range []string{
+		"chat/p/net1/c/msg",
+		"chat/p/net1/c/msg/text",
+		"chat/p/net2/c/msg",
+		"chat/p/net1",
+		"other/topic",
+	} {
+		if err := client.Publish(topic, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectMsgs(t, patterns[0], &recs[0], "chat/p/net1/c/msg x", "chat/p/net2/c/msg x")
+	expectMsgs(t, patterns[1], &recs[1],
+		"chat/p/net1/c/msg x", "chat/p/net1/c/msg/text x", "chat/p/net2/c/msg x")
+	expectMsgs(t, patterns[2], &recs[2],
+		"chat/p/net1/c/msg x", "chat/p/net1/c/msg/text x", "chat/p/net1 x")
+	expectMsgs(t, patterns[3], &recs[3], "chat/p/net1/c/msg x", "chat/p/net2/c/msg x")
+	expectMsgs(t, patterns[4], &recs[4], "chat/p/net1/c/msg x", "chat/p/net1/c/msg/text x",
+		"chat/p/net2/c/msg x", "chat/p/net1 x", "other/topic x")
+
+	for _, pattern := range []string{"chat/#/msg", "chat/a+/b", "chat/x#"} {
+		if err := client.Subscribe(pattern, func(string, []byte) {}); err == nil {
+			t.Errorf("subscribe to invalid pattern %q should fail", pattern)
+		}
+	}
+}
+
+func TestBrokerUnsubscribe(t *testing.T) {
+	broker := &mqtt.Broker{}
+	client1 := broker.NewClient()
+	defer client1.Close()
+	client2 := broker.NewClient()
+	defer client2.Close()
+
+	var r1a, r1b, r2 recorder
+	if err := client1.Subscribe("a/+", r1a.handle); err != nil {
+		t.Fatal(err)
+	}
+	if err := client1.Subscribe("a/#", r1b.handle); err != nil {
+		t.Fatal(err)
+	}
+	if err := client2.Subscribe("a/+", r2.handle); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the client's own subscription to the pattern is removed.
+	if err := client1.Unsubscribe("a/+"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client1.Publish("a/b", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	expectMsgs(t, "client1 a/+", &r1a)
+	expectMsgs(t, "client1 a/#", &r1b, "a/b 1")
+	expectMsgs(t, "client2 a/+", &r2, "a/b 1")
+
+	// Unsubscribing from a pattern not subscribed is not an error.
+	if err := client1.Unsubscribe("x/y"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client1.Unsubscribe(""); err == nil {
+		t.Error("unsubscribe from an empty pattern should fail")
+	}
+
+	// Closing removes all of the client's subscriptions.
+	if err := client1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client2.Publish("a/c", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	expectMsgs(t, "closed client1 a/#", &r1b)
+	expectMsgs(t, "client2 a/+", &r2, "a/c 2")
+
+	if err := client1.Publish("a/c", nil); err != mqtt.ErrClientClosed {
+		t.Errorf("publish after close: got %v, want %v", err, mqtt.ErrClientClosed)
+	}
+	if err := client1.Subscribe("a/c", r1a.handle); err != mqtt.ErrClientClosed {
+		t.Errorf("subscribe after close: got %v, want %v", err, mqtt.ErrClientClosed)
+	}
+	if err := client1.Unsubscribe("a/#"); err != mqtt.ErrClientClosed {
+		t.Errorf("unsubscribe after close: got %v, want %v", err, mqtt.ErrClientClosed)
+	}
+}
@@ -0,0 +1,129 @@
+// Package mqtt is a service transport using MQTT topics.
+// Msgs are published to topic names as in stdchat.Topic,
+// and incoming msgs and commands are received on the InTopic.
+// Only the in-process Broker is provided, there is no MQTT network client:
+// to use a real MQTT broker, implement the Client interface
+// with an MQTT client library.
+// Note: this mqtt sub package is experimental and can change at any time!
+package mqtt
+
+import (
+	"errors"
+	"sync"
+
+	"stdchat.org"
+	"stdchat.org/service"
+)
+
+// Client is a connected MQTT client.
+type Client interface {
+	// Publish the payload to the topic name.
+	Publish(topic string, payload []byte) error
+	// Subscribe to topics matching the pattern, as in stdchat.MatchTopic
+	// The handler must not modify the payload.
+	Subscribe(pattern string, handler func(topic string, payload []byte)) error
+	// Unsubscribe from the pattern.
+	Unsubscribe(pattern string) error
+}
+
+// InTopic returns the default topic name for incoming msgs to the protocol.
+func InTopic(protocol string) string {
+	return "chat-in/" + protocol
+}
+
+// Transport is a service transport publishing to MQTT.
+// Client is required, all other fields are optional.
+type Transport struct {
+	Protocol string
+	Client   Client
+	Codec    stdchat.Codec // wire encoding, defaults to JSON.
+	InTopic  string        // topic for incoming msgs, defaults to InTopic(Protocol)
+	service.WebServer
+	mx      sync.Mutex
+	serving bool // locked by mx
+}
+
+var _ service.Transporter = &Transport{}
+
+func (tp *Transport) GetProtocol() string {
+	return tp.Protocol
+}
+
+func (tp *Transport) Advertise() error {
+	if tp.Client == nil {
+		return errors.New("mqtt client required")
+	}
+	if tp.Protocol == "" {
+		tp.Protocol = "protocol"
+	}
+	if tp.Codec == nil {
+		tp.Codec = stdchat.JSON
+	}
+	if tp.InTopic == "" {
+		tp.InTopic = InTopic(tp.Protocol)
+	}
+	return nil
+}
+
+// Publish the payload to the topic name, see stdchat.Topic
+// The topic is not included in the MQTT payload.
+func (tp *Transport) Publish(network, chat, node string, payload interface{}) error {
+	b, err := tp.Codec.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	topic := stdchat.Topic{Protocol: tp.Protocol, Network: network, Chat: chat, Node: node}
+	return tp.Client.Publish(topic.String(), b)
+}
+
+func (tp *Transport) PublishError(id string, network string, err error) error {
+	msg := &stdchat.NetMsg{}
+	msg.Init(id, "error", tp.Protocol, network)
+	msg.Message.SetText(err.Error())
+	return tp.Publish(network, "", "error", msg)
+}
+
+// Serve subscribes to the InTopic, dispatching incoming msgs to svc.
+// Incoming msgs can be JSON or CBOR.
+// Call after Advertise, and only once.
+func (tp *Transport) Serve(svc service.Servicer) error {
+	tp.mx.Lock()
+	defer tp.mx.Unlock()
+	if tp.serving {
+		return errors.New("already serving")
+	}
+	err := tp.Client.Subscribe(tp.InTopic, func(topic string, payload []byte) {
+		data := payload
+		if stdchat.IsCBOR(data) {
+			var err error
+			data, err = stdchat.CBORToJSON(data)
+			if err != nil {
+				svc.GenericError(err)
+				return
+			}
+		}
+		if err := service.DispatchMsg(svc, data); err != nil {
+			svc.GenericError(err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	tp.serving = true
+	return nil
+}
+
+// Close stops serving, the Client is not closed.
+func (tp *Transport) Close() error {
+	tp.mx.Lock()
+	defer tp.mx.Unlock()
+	var err error
+	if tp.serving {
+		tp.serving = false
+		err = tp.Client.Unsubscribe(tp.InTopic)
+	}
+	if werr := tp.WebServer.Close(); werr != nil && err == nil {
+		err = werr
+	}
+	return err
+}
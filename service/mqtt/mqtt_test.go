@@ -0,0 +1,73 @@
+package mqtt_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"stdchat.org"
+	"stdchat.org/service/dummy"
+	"stdchat.org/service/mqtt"
+)
+
+func TestTransportServe(t *testing.T) {
+	broker := &mqtt.Broker{}
+	tp := &mqtt.Transport{Protocol: dummy.Protocol, Client: broker.NewClient()}
+	svc := dummy.NewService(tp)
+	defer svc.Close()
+	if err := tp.Advertise(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tp.Serve(svc); err != nil {
+		t.Fatal(err)
+	}
+
+	client := broker.NewClient()
+	defer client.Close()
+	pongs := make(chan stdchat.Topic, 2)
+	err := client.Subscribe("chat/"+dummy.Protocol+"/#", func(topic string, payload []byte) {
+		if strings.Contains(string(payload), `"other/ping"`) {
+			parsed, _ := stdchat.ParseTopic(topic)
+			pongs <- parsed
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ping := stdchat.NewCmd("1", "ping", "x")
+	jping, err := stdchat.JSON.Marshal(ping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cping, err := stdchat.CBOR.Marshal(ping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range [][]byte{jping, cping} {
+		if err := client.Publish(mqtt.InTopic(dummy.Protocol), payload); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case topic := <-pongs:
+			if topic.Protocol != dummy.Protocol || topic.Node != "other" {
+				t.Errorf("unexpected ping response topic: %+v", topic)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no ping response to %q", payload)
+		}
+	}
+
+	// After closing, incoming msgs are no longer served.
+	if err := tp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Publish(mqtt.InTopic(dummy.Protocol), jping); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-pongs:
+		t.Error("ping response after the transport closed")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,220 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"stdchat.org"
+)
+
+// PlaybackService is a Servicer which plays back a recording from a Recorder,
+// publishing the recorded msgs to the Transporter in order.
+// Playback starts when the first input msg is received,
+// and waits at each recorded input msg for the next input msg,
+// so the msgs published in response to a request follow the request.
+// The recorded request IDs are replaced with the IDs of the input msgs.
+// Speed scales the recorded delays between msgs, 2 is twice as fast,
+// or 0 for no delays, which is useful for tests.
+// Only input msg IDs are used, the input is otherwise ignored.
+type PlaybackService struct {
+	tp      Transporter
+	entries []RecordEntry
+	speed   float64
+	ctx     context.Context
+	cancel  context.CancelFunc
+	mx      sync.Mutex
+	started bool          // locked by mx
+	input   []string      // input msg IDs not yet played, locked by mx
+	notify  chan struct{} // input added
+	done    chan struct{} // playback finished
+}
+
+var _ Servicer = &PlaybackService{}
+
+// NewPlaybackService creates a PlaybackService, see ReadRecording.
+func NewPlaybackService(tp Transporter, entries []RecordEntry, speed float64) *PlaybackService {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &PlaybackService{
+		tp:      tp,
+		entries: entries,
+		speed:   speed,
+		ctx:     ctx,
+		cancel:  cancel,
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// Done is closed when the playback is finished or closed.
+func (svc *PlaybackService) Done() <-chan struct{} {
+	return svc.done
+}
+
+func (svc *PlaybackService) addInput(id string) {
+	svc.mx.Lock()
+	if svc.Closed() {
+		svc.mx.Unlock()
+		return
+	}
+	svc.input = append(svc.input, id)
+	start := !svc.started
+	svc.started = true
+	svc.mx.Unlock()
+	if start {
+		go svc.play()
+	}
+	select {
+	case svc.notify <- struct{}{}:
+	default:
+	}
+}
+
+// nextInput waits for the next input msg ID, returns false if closed.
+func (svc *PlaybackService) nextInput() (string, bool) {
+	for {
+		svc.mx.Lock()
+		if len(svc.input) > 0 {
+			id := svc.input[0]
+			svc.input = svc.input[1:]
+			svc.mx.Unlock()
+			return id, true
+		}
+		svc.mx.Unlock()
+		select {
+		case <-svc.notify:
+		case <-svc.ctx.Done():
+			return "", false
+		}
+	}
+}
+
+func (svc *PlaybackService) play() {
+	defer close(svc.done)
+	ids := make(map[string]string) // recorded ID -> input ID
+	var last time.Duration
+	for i := range svc.entries {
+		entry := &svc.entries[i]
+		if entry.Dir == RecordIn {
+			id, ok := svc.nextInput()
+			if !ok {
+				return
+			}
+			if recID := playbackMsgID(entry.Payload); recID != "" && id != "" {
+				ids[recID] = id
+			}
+			last = entry.Time // Delays are from when the input arrives.
+			continue
+		}
+		if svc.speed > 0 && entry.Time > last {
+			t := time.NewTimer(time.Duration(float64(entry.Time-last) / svc.speed))
+			select {
+			case <-t.C:
+			case <-svc.ctx.Done():
+				t.Stop()
+				return
+			}
+		}
+		last = entry.Time
+		if svc.Closed() {
+			return
+		}
+		env := entry.RawEnvelope // Payload stays raw JSON when published.
+		env.Payload = playbackReplaceID(env.Payload, ids)
+		svc.tp.Publish(env.Network, env.Chat, env.Node, env.Payload)
+	}
+}
+
+func playbackMsgID(payload []byte) string {
+	var msg struct {
+		ID string `json:"id"`
+	}
+	stdchat.JSON.Unmarshal(payload, &msg)
+	return msg.ID
+}
+
+// playbackReplaceID replaces the recorded request ID in the payload,
+// including IDs of the form requestID@suffix, see RequestID.
+func playbackReplaceID(payload []byte, ids map[string]string) []byte {
+	if len(ids) == 0 {
+		return payload
+	}
+	recID := playbackMsgID(payload)
+	if recID == "" {
+		return payload
+	}
+	id, ok := ids[recID]
+	if !ok {
+		i := strings.LastIndexByte(recID, '@')
+		if i == -1 {
+			return payload
+		}
+		id, ok = ids[recID[:i]]
+		if !ok {
+			return payload
+		}
+		id += recID[i:]
+	}
+	oldb, _ := stdchat.JSON.Marshal(recID)
+	newb, _ := stdchat.JSON.Marshal(id)
+	// The ID is near the start, before any nested msg IDs.
+	return bytes.Replace(payload, append([]byte(`"id":`), oldb...),
+		append([]byte(`"id":`), newb...), 1)
+}
+
+func (svc *PlaybackService) Handler(msg *stdchat.ChatMsg) {
+	svc.addInput(msg.ID)
+}
+
+func (svc *PlaybackService) CmdHandler(msg *stdchat.CmdMsg) {
+	svc.addInput(msg.ID)
+}
+
+func (svc *PlaybackService) GenericError(err error) {
+	svc.tp.PublishError("", "", err)
+}
+
+func (svc *PlaybackService) GetClients() []Networker {
+	return nil
+}
+
+func (svc *PlaybackService) GetClientByNetwork(networkID string) Networker {
+	return nil
+}
+
+func (svc *PlaybackService) Protocol() string {
+	return svc.tp.GetProtocol()
+}
+
+func (svc *PlaybackService) Context() context.Context {
+	return svc.ctx
+}
+
+func (svc *PlaybackService) Closed() bool {
+	return svc.ctx.Err() != nil
+}
+
+func (svc *PlaybackService) GetStateInfo() ServiceStateInfo {
+	return ServiceStateInfo{}
+}
+
+// Close stops the playback.
+func (svc *PlaybackService) Close() error {
+	svc.mx.Lock()
+	if svc.Closed() {
+		svc.mx.Unlock()
+		return errors.New("already closed")
+	}
+	svc.cancel()
+	started := svc.started
+	svc.mx.Unlock()
+	if started {
+		<-svc.done
+	} else {
+		close(svc.done)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"stdchat.org"
+)
+
+// Directions of a RecordEntry.
+const (
+	RecordIn  = "in"  // an input msg, as given to DispatchMsg.
+	RecordOut = "out" // a published msg.
+)
+
+// RecordEntry is a msg in a recording, see Recorder.
+// The topic is only set for RecordOut.
+type RecordEntry struct {
+	Time time.Duration `json:"t"` // since the recording started.
+	Dir  string        `json:"dir"`
+	stdchat.RawEnvelope
+}
+
+type recordOut struct {
+	Time time.Duration `json:"t"`
+	Dir  string        `json:"dir"`
+	stdchat.Envelope
+}
+
+var ErrRecorderClosed = errors.New("recorder closed")
+
+// Recorder is a transport recording a session to W,
+// the published msgs along with the input msgs from RecordIn,
+// each as a line of JSON with the time since the recording started.
+// Use it along with other transports in a MultiTransport,
+// and use RecordService to record the input msgs.
+// Use ReadRecording and PlaybackService to play it back.
+// It is thread safe.
+type Recorder struct {
+	Protocol string
+	W        io.Writer // closed by Close if an io.Closer.
+	WebServer
+	mx     sync.Mutex
+	start  time.Time // locked by mx
+	err    error     // locked by mx
+	closed bool      // locked by mx
+}
+
+var _ Transporter = &Recorder{}
+
+func (rec *Recorder) GetProtocol() string {
+	return rec.Protocol
+}
+
+// Advertise starts the recording, if not already started.
+func (rec *Recorder) Advertise() error {
+	if rec.Protocol == "" {
+		rec.Protocol = "protocol"
+	}
+	rec.mx.Lock()
+	defer rec.mx.Unlock()
+	if rec.start.IsZero() {
+		rec.start = time.Now()
+	}
+	return nil
+}
+
+// write the entry as a line, call with mx locked.
+func (rec *Recorder) write(v interface{}) error {
+	if rec.closed {
+		return ErrRecorderClosed
+	}
+	if rec.err != nil {
+		return rec.err
+	}
+	b, err := stdchat.JSON.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, rec.err = rec.W.Write(append(b, '\n'))
+	return rec.err
+}
+
+// since returns the time since the recording started, call with mx locked.
+func (rec *Recorder) since() time.Duration {
+	if rec.start.IsZero() {
+		rec.start = time.Now()
+	}
+	return time.Since(rec.start)
+}
+
+// RecordIn records an input msg.
+func (rec *Recorder) RecordIn(rawMsg []byte) error {
+	rec.mx.Lock()
+	defer rec.mx.Unlock()
+	entry := &RecordEntry{Time: rec.since(), Dir: RecordIn}
+	entry.Payload = bytes.TrimSpace(rawMsg) // Keep it on one line.
+	return rec.write(entry)
+}
+
+func (rec *Recorder) Publish(network, chat, node string, payload interface{}) error {
+	rec.mx.Lock()
+	defer rec.mx.Unlock()
+	return rec.write(&recordOut{Time: rec.since(), Dir: RecordOut,
+		Envelope: stdchat.Envelope{
+			Topic:   stdchat.Topic{Protocol: rec.Protocol, Network: network, Chat: chat, Node: node},
+			Payload: payload,
+		}})
+}
+
+func (rec *Recorder) PublishError(id string, network string, err error) error {
+	msg := &stdchat.NetMsg{}
+	msg.Init(id, "error", rec.Protocol, network)
+	msg.Message.SetText(err.Error())
+	return rec.Publish(network, "", "error", msg)
+}
+
+// Err returns the first error writing the recording, if any.
+// Nothing more is recorded after an error.
+func (rec *Recorder) Err() error {
+	rec.mx.Lock()
+	defer rec.mx.Unlock()
+	return rec.err
+}
+
+func (rec *Recorder) Close() error {
+	rec.mx.Lock()
+	defer rec.mx.Unlock()
+	var err error
+	if !rec.closed {
+		rec.closed = true
+		if c, ok := rec.W.(io.Closer); ok {
+			err = c.Close()
+		}
+	}
+	if werr := rec.WebServer.Close(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+// RecordService is a Servicer recording the input msgs to the Recorder,
+// see DispatchMsg.
+type RecordService struct {
+	Servicer
+	Recorder *Recorder
+}
+
+var _ MsgDispatcher = &RecordService{}
+
+func (svc *RecordService) DispatchMsg(rawMsg []byte) error {
+	svc.Recorder.RecordIn(rawMsg)
+	return DispatchMsg(svc.Servicer, rawMsg)
+}
+
+// ReadRecording reads all the entries of a recording from a Recorder.
+func ReadRecording(r io.Reader) ([]RecordEntry, error) {
+	var entries []RecordEntry
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			var entry RecordEntry
+			if jerr := stdchat.JSON.Unmarshal(line, &entry); jerr != nil {
+				return entries, jerr
+			}
+			entries = append(entries, entry)
+		}
+		if err != nil {
+			if err == io.EOF {
+				return entries, nil
+			}
+			return entries, err
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"stdchat.org"
+)
+
+var ErrCallClosed = errors.New("request call closed")
+
+// ResponseError is an error msg in response to a request.
+type ResponseError struct {
+	Msg stdchat.BaseMsger
+}
+
+func (err *ResponseError) Error() string {
+	return err.Msg.GetMessageString()
+}
+
+// RequestID returns the request ID from the ID of a response msg,
+// which is the part before the first '@', see MakeID.
+func RequestID(id string) string {
+	if i := strings.IndexByte(id, '@'); i != -1 {
+		return id[:i]
+	}
+	return id
+}
+
+// Correlator matches response msgs to pending requests,
+// using the request ID prefix of the response msg ID, see MakeID.
+// The zero value is ready to use. It is thread safe.
+type Correlator struct {
+	mx     sync.Mutex
+	calls  map[string]*Call // locked by mx
+	closed bool             // locked by mx
+}
+
+// NewCall starts waiting for responses to the request ID.
+// Call this before sending the request, and Close the call when done.
+func (cr *Correlator) NewCall(id string) *Call {
+	call := &Call{ID: id, cr: cr, notify: make(chan struct{}, 1)}
+	cr.mx.Lock()
+	defer cr.mx.Unlock()
+	if cr.closed {
+		call.closed = true
+		return call
+	}
+	if cr.calls == nil {
+		cr.calls = make(map[string]*Call)
+	}
+	if prev := cr.calls[id]; prev != nil {
+		prev.close()
+	}
+	cr.calls[id] = call
+	return call
+}
+
+// Deliver gives the msg to the call it is in response to, if any.
+// Returns true if delivered.
+// The longest matching request ID is used, IDs such as a@b@c match a@b then a.
+func (cr *Correlator) Deliver(msg stdchat.BaseMsger) bool {
+	id := msg.GetID()
+	cr.mx.Lock()
+	var call *Call
+	for id != "" {
+		call = cr.calls[id]
+		if call != nil {
+			break
+		}
+		i := strings.LastIndexByte(id, '@')
+		if i == -1 {
+			break
+		}
+		id = id[:i]
+	}
+	cr.mx.Unlock()
+	if call == nil {
+		return false
+	}
+	call.add(msg)
+	return true
+}
+
+// Close closes all the pending calls, and any new calls.
+// Use this when no more responses can be received.
+func (cr *Correlator) Close() error {
+	cr.mx.Lock()
+	defer cr.mx.Unlock()
+	cr.closed = true
+	for _, call := range cr.calls {
+		call.close()
+	}
+	cr.calls = nil
+	return nil
+}
+
+// Request sends the cmd to the receiver in-process, returns the Call.
+// The responses must be published through a CorrelateTransport using cr.
+// The cmd gets a new ID if it does not have one.
+func (cr *Correlator) Request(rcv Receiver, msg *stdchat.CmdMsg) *Call {
+	if msg.ID == "" {
+		msg.ID = MakeID("")
+	}
+	call := cr.NewCall(msg.ID)
+	rcv.CmdHandler(msg)
+	return call
+}
+
+// Do is Request and then waits for the first response.
+func (cr *Correlator) Do(ctx context.Context, rcv Receiver, msg *stdchat.CmdMsg) (stdchat.BaseMsger, error) {
+	call := cr.Request(rcv, msg)
+	defer call.Close()
+	return call.Wait(ctx)
+}
+
+// Call is a pending request, waiting for responses.
+type Call struct {
+	ID     string // the request ID.
+	cr     *Correlator
+	notify chan struct{}
+	mx     sync.Mutex
+	queue  []stdchat.BaseMsger // locked by mx
+	closed bool                // locked by mx
+}
+
+func (call *Call) add(msg stdchat.BaseMsger) {
+	call.mx.Lock()
+	call.queue = append(call.queue, msg)
+	call.mx.Unlock()
+	select {
+	case call.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (call *Call) close() {
+	call.mx.Lock()
+	call.closed = true
+	call.mx.Unlock()
+	select {
+	case call.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops waiting for responses.
+func (call *Call) Close() error {
+	call.cr.mx.Lock()
+	if call.cr.calls[call.ID] == call {
+		delete(call.cr.calls, call.ID)
+	}
+	call.cr.mx.Unlock()
+	call.close()
+	return nil
+}
+
+// Wait for the next response, a request can have more than one response.
+// If the response is an error msg, it is returned along with a *ResponseError
+// Returns ErrCallClosed if closed and there are no more responses,
+// or the ctx error if done first.
+func (call *Call) Wait(ctx context.Context) (stdchat.BaseMsger, error) {
+	for {
+		call.mx.Lock()
+		if len(call.queue) > 0 {
+			msg := call.queue[0]
+			call.queue = call.queue[1:]
+			call.mx.Unlock()
+			if stdchat.IsType(msg.GetType(), "error") {
+				return msg, &ResponseError{msg}
+			}
+			return msg, nil
+		}
+		closed := call.closed
+		call.mx.Unlock()
+		if closed {
+			return nil, ErrCallClosed
+		}
+		select {
+		case <-call.notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// WaitTimeout is Wait with a timeout.
+func (call *Call) WaitTimeout(timeout time.Duration) (stdchat.BaseMsger, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return call.Wait(ctx)
+}
+
+// CorrelateTransport is a Transporter which delivers published msgs
+// to the Correlator, and also publishes them to the Transporter.
+// Use this for in-process requests, see Correlator.Request
+type CorrelateTransport struct {
+	Transporter
+	Correlator *Correlator
+}
+
+var _ Transporter = &CorrelateTransport{}
+
+func (tp *CorrelateTransport) Publish(network, chat, node string, payload interface{}) error {
+	if msg, ok := payload.(stdchat.BaseMsger); ok {
+		tp.Correlator.Deliver(msg)
+	}
+	return tp.Transporter.Publish(network, chat, node, payload)
+}
+
+func (tp *CorrelateTransport) PublishError(id string, network string, err error) error {
+	msg := &stdchat.NetMsg{}
+	msg.Init(id, "error", tp.GetProtocol(), network)
+	msg.Message.SetText(err.Error())
+	return tp.Publish(network, "", "error", msg)
+}
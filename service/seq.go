@@ -0,0 +1,136 @@
+package service
+
+import (
+	"sort"
+	"sync"
+
+	"stdchat.org"
+)
+
+const DefaultSeqBufferSize = 1000
+
+// SeqTransport numbers each published msg with a sequence number,
+// and keeps recent msgs so they can be replayed after a sequence number.
+// If Log is set, it assigns the sequence numbers and replays the msgs,
+// otherwise the last BufferSize msgs are kept in memory.
+// Msgs are published to the added transports using PublishSeq, in order.
+// It is thread safe.
+type SeqTransport struct {
+	MultiTransporter
+	Log        *LogTransport // optional, must already be advertised.
+	BufferSize int           // if no Log, defaults to DefaultSeqBufferSize
+	mx         sync.Mutex
+	seq        uint64             // if no Log, locked by mx
+	buf        []stdchat.Envelope // if no Log, locked by mx
+}
+
+var _ MultiTransporter = &SeqTransport{}
+var _ SeqPublisher = &SeqTransport{}
+
+func (tp *SeqTransport) Publish(network, chat, node string, payload interface{}) error {
+	tp.mx.Lock()
+	defer tp.mx.Unlock()
+	topic := stdchat.Topic{Protocol: tp.GetProtocol(), Network: network, Chat: chat, Node: node}
+	var seq uint64
+	var logErr error
+	if tp.Log != nil {
+		seq, logErr = tp.Log.Append(topic, payload)
+	} else {
+		tp.seq++
+		seq = tp.seq
+		size := tp.BufferSize
+		if size <= 0 {
+			size = DefaultSeqBufferSize
+		}
+		if len(tp.buf) >= size {
+			tp.buf = append(tp.buf[:0], tp.buf[len(tp.buf)-size+1:]...)
+		}
+		tp.buf = append(tp.buf, stdchat.Envelope{Topic: topic, Seq: seq, Payload: payload})
+	}
+	// Still publish if the log failed, without a sequence number.
+	err := tp.PublishSeq(seq, network, chat, node, payload)
+	if logErr != nil {
+		return logErr
+	}
+	return err
+}
+
+// PublishSeq publishes to the MultiTransporter with the sequence number.
+func (tp *SeqTransport) PublishSeq(seq uint64, network, chat, node string, payload interface{}) error {
+	if sp, ok := tp.MultiTransporter.(SeqPublisher); ok {
+		return sp.PublishSeq(seq, network, chat, node, payload)
+	}
+	return tp.MultiTransporter.Publish(network, chat, node, payload)
+}
+
+func (tp *SeqTransport) PublishError(id string, network string, err error) error {
+	msg := &stdchat.NetMsg{}
+	msg.Init(id, "error", tp.GetProtocol(), network)
+	msg.Message.SetText(err.Error())
+	return tp.Publish(network, "", "error", msg)
+}
+
+// LastSeq returns the sequence number of the last msg, or 0 if none.
+func (tp *SeqTransport) LastSeq() uint64 {
+	if tp.Log != nil {
+		return tp.Log.LastSeq()
+	}
+	tp.mx.Lock()
+	defer tp.mx.Unlock()
+	return tp.seq
+}
+
+// Replay calls fn for each msg after the sequence number, in order.
+// The msgs are copied before calling fn, so publishing is not blocked by fn,
+// and msgs published meanwhile are replayed by a second pass.
+// Payloads replayed from the Log are raw JSON.
+// Returns ErrSeqNotFound if the msgs after seq are no longer kept.
+func (tp *SeqTransport) Replay(after uint64, fn func(env *stdchat.Envelope) error) error {
+	last, err := tp.replay(after, fn)
+	if err != nil || last == after {
+		return err
+	}
+	_, err = tp.replay(last, fn)
+	return err
+}
+
+// replay is a pass of Replay, returns the last sequence number replayed.
+func (tp *SeqTransport) replay(after uint64, fn func(env *stdchat.Envelope) error) (uint64, error) {
+	if tp.Log != nil {
+		last := after
+		err := tp.Log.Replay(after, func(entry *LogEntry) error {
+			last = entry.Seq
+			return fn(&stdchat.Envelope{Topic: entry.Topic, Seq: entry.Seq, Payload: entry.Payload})
+		})
+		return last, err
+	}
+	tp.mx.Lock()
+	if after >= tp.seq {
+		tp.mx.Unlock()
+		return after, nil
+	}
+	if len(tp.buf) == 0 || tp.buf[0].Seq > after+1 {
+		tp.mx.Unlock()
+		return after, ErrSeqNotFound
+	}
+	i := sort.Search(len(tp.buf), func(i int) bool { return tp.buf[i].Seq > after })
+	envs := append([]stdchat.Envelope(nil), tp.buf[i:]...)
+	tp.mx.Unlock()
+	for i := range envs {
+		if err := fn(&envs[i]); err != nil {
+			return after, err
+		}
+	}
+	return envs[len(envs)-1].Seq, nil
+}
+
+// Close closes the MultiTransporter and the Log.
+func (tp *SeqTransport) Close() error {
+	err := tp.MultiTransporter.Close()
+	if tp.Log != nil {
+		if lerr := tp.Log.Close(); err == nil {
+			err = lerr
+		}
+	}
+	return err
+}
@@ -44,6 +44,19 @@ type Receiver interface {
 	CmdHandler(msg *stdchat.CmdMsg)
 }
 
+// EditReceiver can receive outgoing msg edit and delete requests.
+// A Networker implements this if its protocol supports it.
+type EditReceiver interface {
+	EditHandler(msg *stdchat.MsgEditedMsg)
+	DeleteHandler(msg *stdchat.MsgDeletedMsg)
+}
+
+// ReactionReceiver can receive outgoing reaction requests.
+// A Networker implements this if its protocol supports it.
+type ReactionReceiver interface {
+	ReactionHandler(msg *stdchat.ReactionMsg)
+}
+
 type NewClientFunc = func(svc *Service, remote, userID, auth string, values stdchat.ValuesInfo) (Networker, error)
 
 // Service is a service.
@@ -54,11 +67,14 @@ type Service struct {
 	newClient   NewClientFunc
 	mx          sync.RWMutex
 	newClientMx sync.Mutex
-	closed      int32 // atomic
-	Verbose     bool  // verbose output to log.Print/Printf
+	closed      int32    // atomic
+	Verbose     bool     // verbose output to log.Print/Printf
+	Formats     []string // MIME types of msgs the protocol emits, for get-state.
 }
 
 var _ Servicer = &Service{}
+var _ EditReceiver = &Service{}
+var _ ReactionReceiver = &Service{}
 
 // NewService creates a new service.
 // newClient must be set to a function, a lock will be acquired during newClient.
@@ -318,17 +334,74 @@ func (svc *Service) CmdHandler(msg *stdchat.CmdMsg) {
 	}
 }
 
-func (svc *Service) Handler(msg *stdchat.ChatMsg) {
+// getMsgClient gets the client for the msg's network,
+// or publishes an error and returns nil.
+func (svc *Service) getMsgClient(msg *stdchat.ChatMsg) Networker {
 	if msg.Type == "" || msg.Network.ID == "" {
 		svc.tp.PublishError(MakeID(msg.ID), "",
 			errors.New("invalid message"))
-	} else {
-		client := svc.GetClientByNetwork(msg.Network.ID)
-		if client == nil {
-			svc.tp.PublishError(MakeID(msg.ID), "",
-				errors.New("network not found: "+msg.Network.ID))
+		return nil
+	}
+	client := svc.GetClientByNetwork(msg.Network.ID)
+	if client == nil {
+		svc.tp.PublishError(MakeID(msg.ID), "",
+			errors.New("network not found: "+msg.Network.ID))
+		return nil
+	}
+	return client
+}
+
+func (svc *Service) Handler(msg *stdchat.ChatMsg) {
+	client := svc.getMsgClient(msg)
+	if client != nil {
+		client.Handler(msg)
+	}
+}
+
+// getTargetClient is getMsgClient for a msg targeting another msg by msgID.
+func (svc *Service) getTargetClient(msg *stdchat.ChatMsg, msgID string) Networker {
+	if msgID == "" {
+		svc.tp.PublishError(MakeID(msg.ID), msg.Network.ID,
+			errors.New("invalid message: expected msgID"))
+		return nil
+	}
+	return svc.getMsgClient(msg)
+}
+
+func (svc *Service) unhandledMsg(msg *stdchat.ChatMsg) {
+	svc.tp.PublishError(MakeID(msg.ID), msg.Network.ID,
+		errors.New("unhandled message of type "+msg.Type))
+}
+
+func (svc *Service) EditHandler(msg *stdchat.MsgEditedMsg) {
+	client := svc.getTargetClient(&msg.ChatMsg, msg.MsgID)
+	if client != nil {
+		if ercv, ok := client.(EditReceiver); ok {
+			ercv.EditHandler(msg)
 		} else {
-			client.Handler(msg)
+			svc.unhandledMsg(&msg.ChatMsg)
+		}
+	}
+}
+
+func (svc *Service) DeleteHandler(msg *stdchat.MsgDeletedMsg) {
+	client := svc.getTargetClient(&msg.ChatMsg, msg.MsgID)
+	if client != nil {
+		if ercv, ok := client.(EditReceiver); ok {
+			ercv.DeleteHandler(msg)
+		} else {
+			svc.unhandledMsg(&msg.ChatMsg)
+		}
+	}
+}
+
+func (svc *Service) ReactionHandler(msg *stdchat.ReactionMsg) {
+	client := svc.getTargetClient(&msg.ChatMsg, msg.MsgID)
+	if client != nil {
+		if rrcv, ok := client.(ReactionReceiver); ok {
+			rrcv.ReactionHandler(msg)
+		} else {
+			svc.unhandledMsg(&msg.ChatMsg)
 		}
 	}
 }
@@ -348,6 +421,7 @@ func (svc *Service) GetStateInfo() ServiceStateInfo {
 	msg := ServiceStateInfo{}
 	msg.Protocol.Type = "proto-state"
 	msg.Protocol.Protocol = svc.Protocol()
+	msg.Protocol.Formats = svc.Formats
 	for _, client := range svc.GetClients() {
 		cstate := client.GetStateInfo()
 		msg.Networks = append(msg.Networks, cstate.Network)
@@ -356,8 +430,20 @@ func (svc *Service) GetStateInfo() ServiceStateInfo {
 	return msg
 }
 
+// MsgDispatcher can dispatch raw input messages itself, see DispatchMsg.
+// Useful for wrapping a Servicer, such as RecordService.
+type MsgDispatcher interface {
+	DispatchMsg(rawMsg []byte) error
+}
+
 // DispatchMsg dispatches a raw input message to the receiver (service)
+// Msg edits and deletes go to EditReceiver and reactions go to ReactionReceiver,
+// if the receiver implements them.
+// If the receiver is a MsgDispatcher, it dispatches the msg instead.
 func DispatchMsg(rcv Receiver, rawMsg []byte) error {
+	if d, ok := rcv.(MsgDispatcher); ok {
+		return d.DispatchMsg(rawMsg)
+	}
 	if bytes.Index(rawMsg, []byte(`"cmd`)) != -1 {
 		msg := &stdchat.CmdMsg{}
 		err := stdchat.DecodeMsg(rawMsg, msg)
@@ -376,6 +462,35 @@ func DispatchMsg(rcv Receiver, rawMsg []byte) error {
 	if err != nil {
 		return err
 	}
+	if ercv, ok := rcv.(EditReceiver); ok {
+		switch {
+		case msg.IsType("msg-edited"):
+			emsg := &stdchat.MsgEditedMsg{}
+			err := stdchat.DecodeMsg(rawMsg, emsg)
+			if err != nil {
+				return err
+			}
+			ercv.EditHandler(emsg)
+			return nil
+		case msg.IsType("msg-deleted"):
+			dmsg := &stdchat.MsgDeletedMsg{}
+			err := stdchat.DecodeMsg(rawMsg, dmsg)
+			if err != nil {
+				return err
+			}
+			ercv.DeleteHandler(dmsg)
+			return nil
+		}
+	}
+	if rrcv, ok := rcv.(ReactionReceiver); ok && msg.IsType("reaction") {
+		rmsg := &stdchat.ReactionMsg{}
+		err := stdchat.DecodeMsg(rawMsg, rmsg)
+		if err != nil {
+			return err
+		}
+		rrcv.ReactionHandler(rmsg)
+		return nil
+	}
 	rcv.Handler(msg)
 	return nil
 }
@@ -21,7 +21,7 @@ type Transporter interface {
 	Advertise() error
 	// Publish a message.
 	// network and chat can be empty.
-	// node is the final part in the topic name, as in chat/Protocol/node
+	// node is the final part in the topic name, see stdchat.Topic
 	// e.g. to publish a protocol msg, use Publish("", "", "my-info", payload)
 	Publish(network, chat, node string, payload interface{}) error
 
@@ -78,10 +78,10 @@ func (tp *LocalTransport) PublishError(id string, network string, err error) err
 
 func DefaultLocalTransportPublish(tp *LocalTransport,
 	network, chat, node string, payload interface{}) error {
-	j, err := stdchat.JSON.Marshal(&struct {
-		Node    string      `json:"node"`
-		Payload interface{} `json:"payload"`
-	}{node, payload})
+	j, err := stdchat.EncodeEnvelope(&stdchat.Envelope{
+		Topic:   stdchat.Topic{Protocol: tp.Protocol, Network: network, Chat: chat, Node: node},
+		Payload: payload,
+	}, stdchat.JSON)
 	if err != nil {
 		return err
 	}
@@ -89,6 +89,12 @@ func DefaultLocalTransportPublish(tp *LocalTransport,
 	return err
 }
 
+// SeqPublisher is a transport which can publish msgs with sequence numbers.
+type SeqPublisher interface {
+	// PublishSeq is Publish with the sequence number of the msg, see SeqTransport.
+	PublishSeq(seq uint64, network, chat, node string, payload interface{}) error
+}
+
 type MultiTransporter interface {
 	Transporter
 	AddTransport(transport Transporter)
@@ -174,6 +180,26 @@ func (tp *MultiTransport) Publish(network, chat, node string, payload interface{
 	return mec.GetError()
 }
 
+// PublishSeq is Publish with the sequence number,
+// added transports which are not a SeqPublisher use Publish.
+func (tp *MultiTransport) PublishSeq(seq uint64, network, chat, node string, payload interface{}) error {
+	tp.mx.RLock()
+	defer tp.mx.RUnlock()
+	var mec multiTpErrorCollector
+	for _, tx := range tp.transports {
+		var err error
+		if sp, ok := tx.(SeqPublisher); ok {
+			err = sp.PublishSeq(seq, network, chat, node, payload)
+		} else {
+			err = tx.Publish(network, chat, node, payload)
+		}
+		if err != nil {
+			mec.Add(tx, err)
+		}
+	}
+	return mec.GetError()
+}
+
 func (tp *MultiTransport) PublishError(id string, network string, err error) error {
 	msg := &stdchat.NetMsg{}
 	msg.Init(id, "error", tp.Protocol, network)
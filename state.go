@@ -1,5 +1,10 @@
 package stdchat
 
+import (
+	"sort"
+	"sync"
+)
+
 // Statuser has status info.
 type Statuser interface {
 	GetType() string
@@ -7,11 +12,68 @@ type Statuser interface {
 	String() string
 }
 
+// NewStateFunc creates a new empty state for decoding, it must return a pointer.
+type NewStateFunc = func() Statuser
+
+var stateTypes = struct {
+	mx    sync.RWMutex
+	types map[string]NewStateFunc // locked by mx
+}{types: make(map[string]NewStateFunc)}
+
+// RegisterStateType registers a state type for decoding a StateEntry.
+// newState is used for states of type typ and its subtypes (see IsType),
+// the most specific registered type wins.
+// This lets a provider package publish its own kinds of state,
+// such as a contact list, and have Go clients decode them.
+func RegisterStateType(typ string, newState NewStateFunc) {
+	if typ == "" {
+		panic("empty state type")
+	}
+	if newState == nil {
+		panic("nil newState")
+	}
+	stateTypes.mx.Lock()
+	defer stateTypes.mx.Unlock()
+	stateTypes.types[typ] = newState
+}
+
+// LookupStateType finds the most specific registered state type for stateType,
+// or returns nil if none.
+func LookupStateType(stateType string) NewStateFunc {
+	stateTypes.mx.RLock()
+	defer stateTypes.mx.RUnlock()
+	for typ := stateType; typ != ""; typ = ParentType(typ) {
+		if newState, ok := stateTypes.types[typ]; ok {
+			return newState
+		}
+	}
+	return nil
+}
+
+// StateTypes returns the registered state types, sorted.
+func StateTypes() []string {
+	stateTypes.mx.RLock()
+	defer stateTypes.mx.RUnlock()
+	list := make([]string, 0, len(stateTypes.types))
+	for typ := range stateTypes.types {
+		list = append(list, typ)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func init() {
+	RegisterStateType("proto-state", func() Statuser { return &ProtocolStateInfo{} })
+	RegisterStateType("network-state", func() Statuser { return &NetworkStateInfo{} })
+	RegisterStateType("subscription-state", func() Statuser { return &SubscriptionStateInfo{} })
+}
+
 // ProtocolStateInfo is protocol state information.
 type ProtocolStateInfo struct {
 	TypeInfo            // proto-state
 	Protocol string     `json:"proto"`
 	Values   ValuesInfo `json:"values,omitempty"`
+	Formats  []string   `json:"formats,omitempty"` // MIME types of msgs the protocol emits.
 }
 
 func (x ProtocolStateInfo) GetProtocol() string {
@@ -44,16 +106,21 @@ func (x NetworkStateInfo) String() string {
 
 // SubscriptionStateInfo is subscription state information.
 // HistoryURL can be a URL with a known JSON REST API to fetch history, if supported.
-// TODO: define history API.
+// See HistoryQuery and HistoryResult for the history API.
 type SubscriptionStateInfo struct {
 	TypeInfo                 // subscription-state
 	Network     EntityInfo   `json:"net"`
 	Protocol    string       `json:"proto"`
 	Destination EntityInfo   `json:"dest"`
+	Thread      EntityInfo   `json:"thread,omitempty"` // if subscribed to a thread.
 	Subject     MessageInfo  `json:"subject,omitempty"`
 	Members     []MemberInfo `json:"members,omitempty"`
 	Values      ValuesInfo   `json:"values,omitempty"`
-	HistoryURL  string       `json:"history,omitempty"` // empty if not supported.
+	HistoryURL  string       `json:"history,omitempty"`    // empty if not supported.
+	Emoji       []EmojiInfo  `json:"emoji,omitempty"`      // custom emoji available for reactions.
+	Threads     []ThreadInfo `json:"threads,omitempty"`    // known threads, if supported.
+	ReadMarker  string       `json:"readMarker,omitempty"` // ID of the last msg read by myself.
+	Unread      int          `json:"unread,omitempty"`     // number of msgs after ReadMarker.
 }
 
 func (x SubscriptionStateInfo) GetProtocol() string {